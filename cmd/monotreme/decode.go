@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dpw/monotreme/comms"
+)
+
+func decode(args []string) {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Synopsis:\n  %s decode [file]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Decode a captured protocol byte stream from file, or from\nstandard input if no file is given.\n")
+	}
+
+	fs.Parse(args)
+
+	var in io.Reader = os.Stdin
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		defer f.Close()
+		in = f
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := comms.Decode(in, os.Stdout); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
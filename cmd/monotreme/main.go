@@ -4,28 +4,67 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/dpw/monotreme/comms"
+	"github.com/dpw/monotreme/propagation"
 )
 
 func main() {
-	var bindAddr string
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "decode":
+			decode(os.Args[2:])
+			return
+		case "sim":
+			simulate(os.Args[2:])
+			return
+		}
+	}
+
+	var bindAddr, jsonAddr, tree string
 	flag.StringVar(&bindAddr, "b", ":8080", "bind address")
+	flag.StringVar(&jsonAddr, "j", "",
+		"bind address for the JSON-lines debug protocol")
+	flag.StringVar(&tree, "tree", "bushy",
+		"spanning tree policy: bushy, bfs, degree-bounded, mst or weighted")
+	var statusInterval time.Duration
+	flag.DurationVar(&statusInterval, "status", 0,
+		"print the status of the node at this interval (0 disables)")
+	var k int
+	flag.IntVar(&k, "k", 0,
+		"add links to peers to make the cluster k-edge-connected (0 disables)")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Synopsis:\n  %s [options] peer...\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Synopsis:\n  %s [options] peer...\n  %s decode [file]\n  %s sim [options] [scenario]\n\n", os.Args[0], os.Args[0], os.Args[0])
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
 
-	nd, err := comms.NewNodeDaemon(bindAddr)
+	config := comms.DefaultConfig
+	config.EdgeConnectivity = k
+	policy, ok := treePolicy(tree)
+	if !ok {
+		fmt.Println("unknown tree policy", tree)
+		os.Exit(2)
+	}
+	config.Connectivity.TreePolicy = policy
+
+	nd, err := comms.NewNodeDaemonWithConfig(bindAddr, config)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
+	if jsonAddr != "" {
+		if err := nd.Listen(jsonAddr, comms.JSONProtocol); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
 	for _, arg := range flag.Args() {
 		err := nd.Connect(arg)
 		if err != nil {
@@ -34,9 +73,39 @@ func main() {
 		}
 	}
 
+	if statusInterval > 0 {
+		for range time.Tick(statusInterval) {
+			nd.Status().Write(os.Stdout)
+		}
+	}
+
 	var wait chan struct{}
 
 	for {
 		<-wait
 	}
 }
+
+// The spanning tree policies, by the names accepted by the -tree flag
+func treePolicy(name string) (propagation.TreePolicy, bool) {
+	switch name {
+	case "bushy":
+		return propagation.DefaultConfig.TreePolicy, true
+	case "bfs":
+		return propagation.BFSTreePolicy{Witnesses: 10}, true
+	case "degree-bounded":
+		return propagation.DegreeBoundedTreePolicy{
+			Witnesses: 10,
+			MaxDegree: 4,
+		}, true
+	case "mst":
+		return propagation.MinimumSpanningTreePolicy{Witnesses: 10}, true
+	case "weighted":
+		return propagation.WeightedTreePolicy{
+			Witnesses:      10,
+			SoftChildLimit: 4,
+		}, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,205 @@
+package comms
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dpw/monotreme/graph"
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+// A Cluster is a set of NodeDaemons in one process, for testing.  The
+// daemons are linked through in-memory connections wrapped by a
+// FaultInjector.  Links that fail are redialled after RedialDelay,
+// unless they are cut by a partition.
+type Cluster struct {
+	Nodes       []*NodeDaemon
+	Faults      *FaultInjector
+	RedialDelay time.Duration
+
+	lock   sync.Mutex
+	closed bool
+
+	// The links, keyed by the indices of their nodes, lower first
+	links map[[2]int]*clusterLink
+
+	// The partition group of each node, if partitioned
+	partition map[int]int
+}
+
+type clusterLink struct {
+	// The connections of the current attempt, or nil while the
+	// link is down
+	conns []net.Conn
+}
+
+func NewCluster(n int, config Config, faults *FaultInjector) (*Cluster, error) {
+	c := &Cluster{
+		Faults:      faults,
+		RedialDelay: 10 * time.Millisecond,
+		links:       make(map[[2]int]*clusterLink),
+	}
+
+	for i := 0; i < n; i++ {
+		nd, err := NewNodeDaemonWithConfig("127.0.0.1:0", config)
+		if err != nil {
+			for _, nd := range c.Nodes {
+				nd.Close()
+			}
+
+			return nil, err
+		}
+
+		c.Nodes = append(c.Nodes, nd)
+	}
+
+	return c, nil
+}
+
+func linkKey(i, j int) [2]int {
+	if i > j {
+		i, j = j, i
+	}
+
+	return [2]int{i, j}
+}
+
+// Link two nodes of the cluster, and keep them linked.
+func (c *Cluster) Link(i, j int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := linkKey(i, j)
+	if c.links[key] == nil {
+		l := &clusterLink{}
+		c.links[key] = l
+		c.dial(key, l)
+	}
+}
+
+// Establish a link if it should be up.  Called with the lock held.
+func (c *Cluster) dial(key [2]int, l *clusterLink) {
+	if c.closed || l.conns != nil || c.cut(key) {
+		return
+	}
+
+	a, b := net.Pipe()
+	conns := []net.Conn{c.Faults.Wrap(a), c.Faults.Wrap(b)}
+	l.conns = conns
+
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(nd *NodeDaemon, conn net.Conn) {
+			nd.handleConnection(conn, BinaryProtocol)
+			wg.Done()
+		}(c.Nodes[key[i]], conn)
+	}
+
+	go func() {
+		// When one end hangs up, so does the other
+		wg.Wait()
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		l.conns = nil
+		time.AfterFunc(c.RedialDelay, func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			c.dial(key, l)
+		})
+	}()
+}
+
+// Whether a link is cut by the partition.  Called with the lock held.
+func (c *Cluster) cut(key [2]int) bool {
+	return c.partition[key[0]] != c.partition[key[1]]
+}
+
+// Partition the cluster into groups of nodes, given by their indices,
+// cutting the links between groups.  Nodes not in any group form
+// another group.
+func (c *Cluster) Partition(groups ...[]int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.partition = make(map[int]int)
+	for i, g := range groups {
+		for _, n := range g {
+			c.partition[n] = i + 1
+		}
+	}
+
+	for key, l := range c.links {
+		if c.cut(key) {
+			closeConns(l)
+		}
+	}
+}
+
+// Remove any partition, restoring the links it cut
+func (c *Cluster) Heal() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.partition = nil
+	for key, l := range c.links {
+		c.dial(key, l)
+	}
+}
+
+func closeConns(l *clusterLink) {
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+}
+
+// Close the links of the cluster, stop redialling them, and close the
+// nodes
+func (c *Cluster) Close() {
+	c.lock.Lock()
+	c.closed = true
+	for _, l := range c.links {
+		closeConns(l)
+	}
+	c.lock.Unlock()
+
+	for _, nd := range c.Nodes {
+		nd.Close()
+	}
+}
+
+// Whether the view of the topology of every node matches the links
+// that should be up, i.e. those not cut by the partition.
+func (c *Cluster) Converged() bool {
+	c.lock.Lock()
+	expected := make(map[NodeID][]NodeID)
+	for key := range c.links {
+		if !c.cut(key) {
+			a, b := c.Nodes[key[0]].us, c.Nodes[key[1]].us
+			expected[a] = append(expected[a], b)
+			expected[b] = append(expected[b], a)
+		}
+	}
+	c.lock.Unlock()
+
+	for _, nd := range c.Nodes {
+		var g graph.Graph
+		nd.call(func() { g = nd.connectivity.Graph() })
+		if g.Edges == nil {
+			// The graph has not been computed yet
+			g = graph.ReachableGraph(nd.us, func(NodeID) []NodeID { return nil })
+		}
+
+		want := graph.ReachableGraph(nd.us, func(n NodeID) []NodeID {
+			return expected[n]
+		})
+
+		if !graph.Diff(want, g).Empty() {
+			return false
+		}
+	}
+
+	return true
+}
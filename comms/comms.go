@@ -3,11 +3,15 @@ package comms
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/dpw/monotreme/graph"
 	"github.com/dpw/monotreme/propagation"
 	. "github.com/dpw/monotreme/rudiments"
 )
@@ -23,72 +27,492 @@ func newNodeID() NodeID {
 	return NodeID(hex.EncodeToString(bs))
 }
 
+// Tunable parameters of a NodeDaemon
+type Config struct {
+	// Limits on the size of a message: The maximum number of
+	// updates, and the approximate maximum number of bytes.  Zero
+	// means no limit.
+	MaxBatchUpdates int
+	MaxBatchBytes   int
+
+	// A peer that does not accept a message within this time is
+	// disconnected.  Zero means no limit.
+	WriteTimeout time.Duration
+
+	// How long to wait after a connectivity change before
+	// recomputing the spanning tree, so that a burst of changes
+	// leads to a single recomputation.  Zero means recompute
+	// immediately.
+	RecomputeDelay time.Duration
+
+	// How often to ping peers to measure the RTTs of links.  Zero
+	// disables pings.
+	PingInterval time.Duration
+
+	// If positive, the daemon dials peers in order to make the
+	// cluster k-edge-connected, following the suggestions of
+	// graph.SuggestLinks.  Only the end of a suggested link with
+	// the lower NodeID dials it, and it can only dial peers whose
+	// addresses it knows: those it has connected to before, and
+	// those given to SetPeerAddress.  The suggestions are checked
+	// every AutoLinkInterval.
+	EdgeConnectivity int
+	AutoLinkInterval time.Duration
+
+	// The number of links a datagram may cross, from 1 to 255.
+	// Zero means the default.
+	DatagramHopLimit int
+
+	// Parameters of the spanning tree computation
+	Connectivity propagation.Config
+}
+
+var DefaultConfig = Config{
+	MaxBatchUpdates:  1000,
+	MaxBatchBytes:    64 * 1024,
+	WriteTimeout:     30 * time.Second,
+	RecomputeDelay:   10 * time.Millisecond,
+	PingInterval:     time.Second,
+	AutoLinkInterval: 10 * time.Second,
+	DatagramHopLimit: 16,
+	Connectivity:     propagation.DefaultConfig,
+}
+
+// A NodeDaemon is driven by an event loop: A single goroutine owns
+// the Connectivity and the other state of the daemon, and the
+// goroutines handling connections send it requests through the loop
+// channel.  Requests are handled in the order they are sent, so the
+// updates from a connection are applied in order, and no lock is
+// needed.
 type NodeDaemon struct {
-	us       NodeID
-	listener net.Listener
+	us     NodeID
+	config Config
+	loop   chan func()
+
+	// Closed by Close, to stop the goroutines of the daemon, and
+	// then by the event loop when it stops
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
 
-	lock         sync.Mutex
+	// owned by the event loop
 	connectivity *propagation.Connectivity
+	connections  map[*connection]struct{}
+	listeners    []net.Listener
+	closed       bool
+
+	// Every connection being handled, whether established or
+	// not, so that Close can close them
+	handling map[*connection]struct{}
+
+	// The known addresses of peers
+	addresses map[NodeID]string
+
+	// Consumers of membership events
+	watchers map[*membershipWatcher]struct{}
+
+	// Consumers of datagrams
+	onDatagram    func(source NodeID, payload []byte)
+	onUnreachable func(dest NodeID, payload []byte, err error)
 }
 
 func NewNodeDaemon(bindAddr string) (*NodeDaemon, error) {
-	us := newNodeID()
+	return NewNodeDaemonWithConfig(bindAddr, DefaultConfig)
+}
 
-	l, err := net.Listen("tcp", bindAddr)
-	if err != nil {
-		return nil, err
+func NewNodeDaemonWithConfig(bindAddr string, config Config) (*NodeDaemon, error) {
+	if config.Connectivity.TreePolicy == nil {
+		config.Connectivity.TreePolicy = propagation.DefaultConfig.TreePolicy
 	}
 
+	if config.DatagramHopLimit == 0 {
+		config.DatagramHopLimit = DefaultConfig.DatagramHopLimit
+	} else if config.DatagramHopLimit < 0 || config.DatagramHopLimit > 255 {
+		return nil, fmt.Errorf("DatagramHopLimit %d is not between 1 and 255",
+			config.DatagramHopLimit)
+	}
+
+	us := newNodeID()
+
 	nd := &NodeDaemon{
 		us:           us,
-		listener:     l,
-		connectivity: propagation.NewConnectivity(us),
+		config:       config,
+		connectivity: propagation.NewConnectivityWithConfig(us, config.Connectivity),
+		connections:  make(map[*connection]struct{}),
+		handling:     make(map[*connection]struct{}),
+		loop:         make(chan func(), 100),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+		addresses:    make(map[NodeID]string),
+		watchers:     make(map[*membershipWatcher]struct{}),
+	}
+
+	nd.connectivity.SetMembershipFunc(nd.membershipEvent)
+
+	if config.RecomputeDelay > 0 {
+		nd.connectivity.SetDeferRecompute(func() {
+			time.AfterFunc(config.RecomputeDelay, func() {
+				nd.post(nd.connectivity.Recompute)
+			})
+		})
+	}
+
+	go nd.run()
+
+	if err := nd.Listen(bindAddr, BinaryProtocol); err != nil {
+		nd.Close()
+		return nil, err
+	}
+
+	if config.EdgeConnectivity > 0 {
+		go nd.autoLink()
 	}
 
-	go nd.acceptConnections()
 	return nd, nil
 }
 
-func (nd *NodeDaemon) acceptConnections() {
+func (nd *NodeDaemon) run() {
+	defer close(nd.stopped)
+	for {
+		select {
+		case f := <-nd.loop:
+			f()
+		case <-nd.done:
+			return
+		}
+	}
+}
+
+// Run f on the event loop without waiting for it.  Once the daemon
+// is closed, f is not run.
+func (nd *NodeDaemon) post(f func()) {
+	select {
+	case nd.loop <- f:
+	case <-nd.done:
+	}
+}
+
+// Run f on the event loop, and wait for it to complete.  Must not
+// be called from the event loop.  Once the daemon is closed, f is
+// not run.
+func (nd *NodeDaemon) call(f func()) {
+	done := make(chan struct{})
+	select {
+	case nd.loop <- func() {
+		f()
+		close(done)
+	}:
+	case <-nd.done:
+		return
+	}
+
+	select {
+	case <-done:
+	case <-nd.stopped:
+	}
+}
+
+var ErrClosed = errors.New("node daemon closed")
+
+// Close the listeners and connections of the daemon, and stop its
+// goroutines.  The daemon cannot be used afterwards.
+func (nd *NodeDaemon) Close() {
+	nd.closeOnce.Do(func() {
+		var listeners []net.Listener
+		var conns []*connection
+		var watchers []*membershipWatcher
+		nd.call(func() {
+			nd.closed = true
+			listeners, nd.listeners = nd.listeners, nil
+			for c := range nd.handling {
+				conns = append(conns, c)
+			}
+			for w := range nd.watchers {
+				watchers = append(watchers, w)
+			}
+		})
+
+		for _, l := range listeners {
+			l.Close()
+		}
+		for _, c := range conns {
+			c.close()
+		}
+		for _, w := range watchers {
+			w.close()
+		}
+
+		close(nd.done)
+	})
+}
+
+func (nd *NodeDaemon) hello() hello {
+	return hello{
+		version: protocolVersion,
+		node:    nd.us,
+		policy:  nd.config.Connectivity.TreePolicyName(),
+	}
+}
+
+// Accept connections on an additional address.  Connections to the
+// listener use the given protocol; a JSONProtocol listener allows
+// nodes to be inspected and fed with updates by hand.  ErrClosed is
+// returned if the daemon is closed.
+func (nd *NodeDaemon) Listen(bindAddr string, proto Protocol) error {
+	l, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return err
+	}
+
+	err = ErrClosed
+	nd.call(func() {
+		if !nd.closed {
+			nd.listeners = append(nd.listeners, l)
+			err = nil
+		}
+	})
+
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	go nd.acceptConnections(l, proto)
+	return nil
+}
+
+// The addresses on which the daemon accepts connections
+func (nd *NodeDaemon) Addrs() []net.Addr {
+	var res []net.Addr
+	nd.call(func() {
+		for _, l := range nd.listeners {
+			res = append(res, l.Addr())
+		}
+	})
+	return res
+}
+
+func (nd *NodeDaemon) acceptConnections(l net.Listener, proto Protocol) {
 	for {
-		conn, err := nd.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			// XXX
-			log.Println(err)
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println(err)
+			}
 			return
 		}
 
-		go nd.handleConnection(conn)
+		go nd.handleConnection(conn, proto)
 	}
 }
 
 func (nd *NodeDaemon) Connect(addr string) error {
+	return nd.ConnectProtocol(addr, BinaryProtocol)
+}
+
+// Connect to a peer whose listener uses the given protocol.
+func (nd *NodeDaemon) ConnectProtocol(addr string, proto Protocol) error {
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	go nd.handleConnection(conn)
+	go nd.handleConnectionTo(conn, proto, addr)
+	return nil
+}
+
+// Record the address of a peer, for use by EdgeConnectivity.
+func (nd *NodeDaemon) SetPeerAddress(node NodeID, addr string) {
+	nd.post(func() { nd.addresses[node] = addr })
+}
+
+// The most links suggested for the cluster in each check, which
+// bounds the work done by a check
+const maxAutoLinks = 64
+
+func (nd *NodeDaemon) autoLink() {
+	ticker := time.NewTicker(nd.config.AutoLinkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-nd.done:
+			return
+		}
+
+		// The suggestions can take a while to compute for a
+		// large cluster, so they are computed off the event
+		// loop
+		var g graph.Graph
+		nd.call(func() { g = nd.connectivity.Graph() })
+
+		// Both ends of a suggested link might know the other's
+		// address.  So that they don't both dial, and then
+		// drop both connections as duplicates, only the node
+		// with the lower NodeID dials.
+		var peers []NodeID
+		for _, e := range graph.SuggestLinks(g, nd.config.EdgeConnectivity, maxAutoLinks) {
+			if e.A == nd.us {
+				peers = append(peers, e.B)
+			}
+		}
+
+		var addrs []string
+		nd.call(func() { addrs = nd.linksToDial(peers) })
+		for _, addr := range addrs {
+			log.Println("adding link to", addr)
+			if err := nd.Connect(addr); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// The addresses to dial for links to the given peers.  Called on the
+// event loop.
+func (nd *NodeDaemon) linksToDial(peers []NodeID) []string {
+	var res []string
+	for _, n := range peers {
+		if addr, known := nd.addresses[n]; known && !nd.connectedTo(n) {
+			res = append(res, addr)
+		}
+	}
+
+	return res
+}
+
+// Called on the event loop
+func (nd *NodeDaemon) connectedTo(node NodeID) bool {
+	return nd.connectionTo(node) != nil
+}
+
+// The established connection to a peer, or nil.  Called on the event
+// loop.
+func (nd *NodeDaemon) connectionTo(node NodeID) *connection {
+	for c := range nd.connections {
+		if c.stats.Peer == node {
+			return c
+		}
+	}
+
 	return nil
 }
 
 type connection struct {
-	nd        *NodeDaemon
-	conn      net.Conn
+	nd    *NodeDaemon
+	conn  net.Conn
+	proto Protocol
+
+	// The address dialed, or empty for an accepted connection
+	addr string
+
 	closeOnce sync.Once
 	cancel    chan struct{}
 	toSend    chan struct{}
 
-	// protected by the NodeDaemon lock
-	link *propagation.Link
+	// Pings received, to be answered by the write side
+	pongs chan int64
+
+	// Datagrams to be sent by the write side
+	datagrams chan datagram
+
+	// Ping stamps are the time since the connection started
+	started time.Time
+
+	// owned by the event loop
+	closed       bool
+	link         *propagation.Link
+	stats        ConnectionStats
+	writeStarted time.Time
+}
+
+// Statistics about the traffic sent to a peer.  A peer that is
+// falling behind shows a growing Backlog, and a Stalled time that
+// approaches the WriteTimeout.
+type ConnectionStats struct {
+	Peer NodeID
+
+	// The number of updates waiting to be sent to the peer
+	Backlog int
+
+	// Totals of the messages, updates and bytes sent
+	Messages uint64
+	Updates  uint64
+	Bytes    uint64
+
+	// The number of messages cut short by the batch limits
+	LimitedMessages uint64
+
+	// How long the write in progress has been blocked, or zero
+	Stalled time.Duration
+
+	// How long the most recent write took
+	LastWrite time.Duration
+
+	// The smoothed RTT of the connection, or zero if it has not
+	// been measured
+	RTT time.Duration
+
+	// Whether the link is a bridge, so that its failure would
+	// partition the cluster
+	Bridge bool
 }
 
-func (nd *NodeDaemon) handleConnection(conn net.Conn) {
+// Get statistics for the established connections
+func (nd *NodeDaemon) ConnectionStats() []ConnectionStats {
+	var res []ConnectionStats
+
+	nd.call(func() {
+		bridges := make(map[NodeID]bool)
+		for _, n := range nd.connectivity.BridgeLinks() {
+			bridges[n] = true
+		}
+
+		now := time.Now()
+		for c := range nd.connections {
+			stats := c.stats
+			stats.Backlog = c.link.Backlog()
+			stats.Bridge = bridges[stats.Peer]
+			if !c.writeStarted.IsZero() {
+				stats.Stalled = now.Sub(c.writeStarted)
+			}
+
+			res = append(res, stats)
+		}
+	})
+
+	return res
+}
+
+func (nd *NodeDaemon) handleConnection(conn net.Conn, proto Protocol) {
+	nd.handleConnectionTo(conn, proto, "")
+}
+
+func (nd *NodeDaemon) handleConnectionTo(conn net.Conn, proto Protocol, addr string) {
 	c := connection{
-		nd:     nd,
-		conn:   conn,
-		cancel: make(chan struct{}),
-		toSend: make(chan struct{}, 1),
+		nd:        nd,
+		conn:      conn,
+		proto:     proto,
+		addr:      addr,
+		cancel:    make(chan struct{}),
+		toSend:    make(chan struct{}, 1),
+		pongs:     make(chan int64, 1),
+		datagrams: make(chan datagram, datagramQueueLen),
+		started:   time.Now(),
+	}
+
+	handling := false
+	nd.call(func() {
+		if !nd.closed {
+			nd.handling[&c] = struct{}{}
+			handling = true
+		}
+	})
+
+	if !handling {
+		conn.Close()
+		return
 	}
 
 	go func() {
@@ -104,83 +528,259 @@ func (nd *NodeDaemon) handleConnection(conn net.Conn) {
 	}
 }
 
+// Count the bytes written to a connection
+type countingWriter struct {
+	io.Writer
+	count uint64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.Writer.Write(p)
+	cw.count += uint64(n)
+	return n, err
+}
+
 func (c *connection) writeSide() error {
-	w := newWriter(c.conn)
+	cw := &countingWriter{Writer: c.conn}
+	w := newMessageWriter(cw, c.proto)
 
-	writeNodeID(w, c.nd.us)
-	if err := w.endMessage(); err != nil {
+	c.setWriteDeadline()
+	if err := w.writeHello(c.nd.hello()); err != nil {
 		return err
 	}
 
+	// Pings are only sent between nodes, not to JSON clients
+	var pings <-chan time.Time
+	if interval := c.nd.config.PingInterval; interval > 0 &&
+		c.proto == BinaryProtocol {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		pings = ticker.C
+
+		if err := c.writePing(w); err != nil {
+			return err
+		}
+	}
+
 	for {
+		var err error
 		select {
 		case <-c.cancel:
 			return nil
 		case <-c.toSend:
+			err = c.writePending(w, cw)
+		case <-pings:
+			err = c.writePing(w)
+		case stamp := <-c.pongs:
+			err = c.writePong(w, stamp)
+		case d := <-c.datagrams:
+			c.setWriteDeadline()
+			err = w.writeDatagram(d)
 		}
 
-		if err := c.writePending(w); err != nil {
+		if err != nil {
 			return err
 		}
 	}
 }
 
-func (c *connection) writePending(w *writer) error {
-	var propUpdates map[*propagation.Propagation][]propagation.Update
+func (c *connection) setWriteDeadline() time.Time {
+	now := time.Now()
+	if c.nd.config.WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(now.Add(c.nd.config.WriteTimeout))
+	}
 
-	func() {
-		c.nd.lock.Lock()
-		defer c.nd.lock.Unlock()
-		propUpdates = c.link.Outgoing()
-	}()
+	return now
+}
 
-	for prop, updates := range propUpdates {
-		writeConnectivityUpdates(w, updates)
-		if err := w.endMessage(); err != nil {
-			return err
+func (c *connection) writePing(w messageWriter) error {
+	return w.writePing(int64(c.setWriteDeadline().Sub(c.started)))
+}
+
+func (c *connection) writePong(w messageWriter, stamp int64) error {
+	c.setWriteDeadline()
+	return w.writePong(stamp)
+}
+
+// Write batches of pending updates until there are none left.
+func (c *connection) writePending(w messageWriter, cw *countingWriter) error {
+	config := &c.nd.config
+
+	for {
+		var propUpdates map[*propagation.Propagation][]propagation.Update
+
+		c.nd.call(func() {
+			if c.link != nil {
+				propUpdates = c.link.OutgoingBatch(config.MaxBatchUpdates)
+			}
+		})
+
+		if len(propUpdates) == 0 {
+			return nil
+		}
+
+		for prop, updates := range propUpdates {
+			updates, limited := limitBatchBytes(c.proto, updates,
+				config.MaxBatchBytes)
+
+			start := c.setWriteDeadline()
+			c.nd.post(func() { c.writeStarted = start })
+
+			before := cw.count
+			if err := w.writeUpdates(updates); err != nil {
+				return err
+			}
+
+			prop := prop
+			written := cw.count - before
+			duration := time.Since(start)
+			c.nd.post(func() {
+				c.writeStarted = time.Time{}
+				c.stats.LastWrite = duration
+				c.stats.Messages++
+				c.stats.Updates += uint64(len(updates))
+				c.stats.Bytes += written
+				if limited {
+					c.stats.LimitedMessages++
+				}
+
+				if c.link != nil {
+					c.link.Delivered(prop, updates)
+				}
+			})
 		}
 
-		func() {
-			c.nd.lock.Lock()
-			defer c.nd.lock.Unlock()
-			c.link.Delivered(prop, updates)
-		}()
+		// Give up promptly if the connection was closed, and
+		// don't hold up pongs behind a long backlog
+		select {
+		case <-c.cancel:
+			return nil
+		case stamp := <-c.pongs:
+			if err := c.writePong(w, stamp); err != nil {
+				return err
+			}
+		default:
+		}
 	}
+}
 
-	return nil
+// Truncate a batch of updates so that its encoding in the protocol
+// does not exceed maxBytes, but always retain at least one update so
+// that progress is made.  Zero maxBytes means no limit.
+func limitBatchBytes(proto Protocol, updates []propagation.Update, maxBytes int) ([]propagation.Update, bool) {
+	if maxBytes <= 0 {
+		return updates, false
+	}
+
+	size := 0
+	for i, u := range updates {
+		size += proto.updateSize(u)
+		if size > maxBytes && i > 0 {
+			return updates[:i], true
+		}
+	}
+
+	return updates, false
 }
 
 func (c *connection) readSide() error {
-	r := newReader(c.conn)
+	r := newMessageReader(c.conn, c.proto)
 
-	them := readNodeID(r)
-	if err := r.endMessage(); err != nil {
+	h, err := r.readHello()
+	if err != nil {
 		return err
 	}
 
-	func() {
-		c.nd.lock.Lock()
-		defer c.nd.lock.Unlock()
+	if h.version != protocolVersion {
+		return fmt.Errorf("peer speaks protocol version %d, but we speak %d",
+			h.version, protocolVersion)
+	}
+
+	them := h.node
+	if ours := c.nd.hello().policy; h.policy != ours {
+		return fmt.Errorf("node %s uses tree policy %q, but we use %q",
+			them, h.policy, ours)
+	}
+
+	c.nd.call(func() {
+		if c.closed {
+			return
+		}
+
+		if c.addr != "" {
+			c.nd.addresses[them] = c.addr
+		}
+
+		if c.nd.connectedTo(them) {
+			err = fmt.Errorf("already linked to %s", them)
+			return
+		}
+
+		log.Println("linked to", them)
 		c.link = c.nd.connectivity.Link(them)
+		c.stats.Peer = them
+		c.nd.connections[c] = struct{}{}
 		c.link.SetPendingFunc(func() {
 			select {
 			case c.toSend <- struct{}{}:
+			default:
+				// the writer is already due to run
 			}
 		})
-	}()
+	})
+
+	if err != nil {
+		return err
+	}
 
 	for {
-		updates := readConnectivityUpdates(r)
-		if err := r.endMessage(); err != nil {
+		msg, err := r.readMessage()
+		if err != nil {
 			return err
 		}
 
-		func() {
-			c.nd.lock.Lock()
-			defer c.nd.lock.Unlock()
-			c.link.Incoming(c.nd.connectivity.ConnectivityPropagation(), updates)
-			log.Println(c.nd.connectivity.Dump())
-		}()
+		switch msg.kind {
+		case updatesMessage:
+			c.nd.post(func() {
+				if c.link != nil {
+					c.link.Incoming(c.nd.connectivity.ConnectivityPropagation(), msg.updates)
+				}
+			})
+
+		case pingMessage:
+			select {
+			case c.pongs <- msg.stamp:
+			default:
+				// A pong is already due; the peer will
+				// ping again
+			}
+
+		case pongMessage:
+			rtt := time.Since(c.started) - time.Duration(msg.stamp)
+			if msg.stamp <= 0 || rtt <= 0 {
+				return fmt.Errorf("bogus pong stamp %d from %s",
+					msg.stamp, them)
+			}
+
+			c.nd.post(func() { c.recordRTT(rtt) })
+
+		case datagramMessage:
+			c.nd.post(func() { c.nd.forward(msg.datagram) })
+		}
+	}
+}
+
+// Incorporate an RTT sample into the smoothed RTT, in the manner of
+// TCP's SRTT.
+func (c *connection) recordRTT(sample time.Duration) {
+	if c.stats.RTT == 0 {
+		c.stats.RTT = sample
+	} else {
+		c.stats.RTT += (sample - c.stats.RTT) / 8
+	}
+
+	if c.link != nil {
+		c.link.SetRTT(c.stats.RTT)
 	}
 }
 
@@ -190,9 +790,16 @@ func (c *connection) close() bool {
 		c.conn.Close()
 		close(c.cancel)
 
-		c.nd.lock.Lock()
-		defer c.nd.lock.Unlock()
-		c.link.Close()
+		c.nd.post(func() {
+			c.closed = true
+			delete(c.nd.handling, c)
+			if c.link != nil {
+				log.Println("unlinked from", c.stats.Peer)
+				c.link.Close()
+				c.link = nil
+				delete(c.nd.connections, c)
+			}
+		})
 
 		closed = true
 	})
@@ -0,0 +1,584 @@
+package comms
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dpw/monotreme/propagation"
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+// Discard the log output of the daemons until the test ends
+func silenceLogs(tb testing.TB) {
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func (nd *NodeDaemon) stateOf(node NodeID) interface{} {
+	var res interface{}
+	nd.call(func() {
+		res = nd.connectivity.ConnectivityPropagation().Get(node, nil)
+	})
+	return res
+}
+
+// Measure how quickly a daemon absorbs streams of updates from
+// several peers at once.
+func benchmarkIncomingUpdates(b *testing.B, peers int) {
+	silenceLogs(b)
+
+	nd, err := NewNodeDaemon("127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer nd.Close()
+
+	ws := make([]*writer, peers)
+	for p := range ws {
+		ours, theirs := net.Pipe()
+		go nd.handleConnection(ours, BinaryProtocol)
+		go io.Copy(io.Discard, theirs)
+
+		ws[p] = newWriter(theirs)
+		h := nd.hello()
+		h.node = peerID(p)
+		if err := ws[p].writeHello(h); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	done := make(chan error)
+	for p, w := range ws {
+		go func(p int, w *writer) {
+			done <- sendUpdates(w, peerID(p), nd.us, b.N/peers)
+		}(p, w)
+	}
+
+	for range ws {
+		if err := <-done; err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for p := range ws {
+		for {
+			s, ok := nd.stateOf(peerID(p)).([]propagation.LinkState)
+			if ok && len(s) == 2 && s[1].Node == "done" {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				b.Fatal("timed out waiting for updates from", peerID(p))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func peerID(p int) NodeID {
+	return NodeID(fmt.Sprint("peer", p))
+}
+
+// Send a stream of updates to the state of a peer node, ending with
+// a recognizable state.
+func sendUpdates(w *writer, peer, us NodeID, count int) error {
+	for i := 0; i <= count; i++ {
+		state := []propagation.LinkState{
+			{Node: us},
+			{Node: NodeID(fmt.Sprint("n", i%10))},
+		}
+		if i == count {
+			state[1].Node = "done"
+		}
+
+		err := w.writeUpdates([]propagation.Update{{
+			Node:    peer,
+			Version: propagation.Version(i),
+			State:   state,
+		}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func BenchmarkIncomingUpdates1(b *testing.B) {
+	benchmarkIncomingUpdates(b, 1)
+}
+
+func BenchmarkIncomingUpdates8(b *testing.B) {
+	benchmarkIncomingUpdates(b, 8)
+}
+
+func TestTreePolicyMismatch(t *testing.T) {
+	silenceLogs(t)
+
+	nd, err := NewNodeDaemon("127.0.0.1:0")
+	require.NoError(t, err)
+	defer nd.Close()
+
+	ours, theirs := net.Pipe()
+	go nd.handleConnection(ours, JSONProtocol)
+	go newJSONWriter(theirs).writeHello(hello{protocolVersion, "peer", "other"})
+
+	// The daemon hangs up without linking to the peer
+	_, err = io.Copy(io.Discard, theirs)
+	require.NoError(t, err)
+	require.Nil(t, nd.stateOf(nd.us))
+}
+
+func TestProtocolVersionMismatch(t *testing.T) {
+	silenceLogs(t)
+
+	nd, err := NewNodeDaemon("127.0.0.1:0")
+	require.NoError(t, err)
+	defer nd.Close()
+
+	for _, proto := range []Protocol{BinaryProtocol, JSONProtocol} {
+		ours, theirs := net.Pipe()
+		go nd.handleConnection(ours, proto)
+		h := nd.hello()
+		h.node = "peer"
+		h.version++
+		go newMessageWriter(theirs, proto).writeHello(h)
+
+		// The daemon hangs up without linking to the peer
+		_, err = io.Copy(io.Discard, theirs)
+		require.NoError(t, err)
+		require.Nil(t, nd.stateOf(nd.us))
+	}
+}
+
+// The hello shown in the JSON protocol documentation is accepted by a
+// daemon with the default configuration
+func TestDocumentedJSONHello(t *testing.T) {
+	silenceLogs(t)
+
+	nd, err := NewNodeDaemon("127.0.0.1:0")
+	require.NoError(t, err)
+	defer nd.Close()
+
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	go nd.handleConnection(ours, JSONProtocol)
+	go io.Copy(io.Discard, theirs)
+	_, err = io.WriteString(theirs,
+		`{"type":"hello","version":1,"node":"a1b2c3","policy":"bushy(witnesses=10,limit=4,margin=1)+incremental"}`+"\n")
+	require.NoError(t, err)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(nd.ConnectionStats()) == 0 {
+		require.True(t, time.Now().Before(deadline))
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(t, NodeID("a1b2c3"), nd.ConnectionStats()[0].Peer)
+}
+
+func TestDefaultTreePolicy(t *testing.T) {
+	config := DefaultConfig
+	config.Connectivity = propagation.Config{}
+	nd, err := NewNodeDaemonWithConfig("127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer nd.Close()
+	require.Equal(t, propagation.DefaultConfig.TreePolicy.Name(),
+		nd.hello().policy)
+}
+
+// With no limits on the size of messages, updates are still sent
+func TestUnlimitedBatches(t *testing.T) {
+	silenceLogs(t)
+
+	config := DefaultConfig
+	config.MaxBatchUpdates = 0
+	config.MaxBatchBytes = 0
+
+	a, err := NewNodeDaemonWithConfig("127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := NewNodeDaemonWithConfig("127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer b.Close()
+
+	ours, theirs := net.Pipe()
+	go a.handleConnection(ours, BinaryProtocol)
+	go b.handleConnection(theirs, BinaryProtocol)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for a.stateOf(b.us) == nil || b.stateOf(a.us) == nil {
+		require.True(t, time.Now().Before(deadline))
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClose(t *testing.T) {
+	silenceLogs(t)
+
+	a, err := NewNodeDaemon("127.0.0.1:0")
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := NewNodeDaemon("127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr := b.Addrs()[0].String()
+	require.NoError(t, a.Connect(addr))
+	deadline := time.Now().Add(10 * time.Second)
+	for len(a.ConnectionStats()) == 0 {
+		require.True(t, time.Now().Before(deadline))
+		time.Sleep(time.Millisecond)
+	}
+
+	// Closing b drops the connection, and its listener
+	b.Close()
+	for len(a.ConnectionStats()) != 0 {
+		require.True(t, time.Now().Before(deadline))
+		time.Sleep(time.Millisecond)
+	}
+
+	require.Error(t, a.Connect(addr))
+	require.Empty(t, b.Addrs())
+	b.Close()
+
+	// A closed daemon does not listen again
+	require.Equal(t, ErrClosed, b.Listen("127.0.0.1:0", BinaryProtocol))
+	require.Empty(t, b.Addrs())
+}
+
+func TestRTT(t *testing.T) {
+	silenceLogs(t)
+
+	config := DefaultConfig
+	config.PingInterval = time.Millisecond
+
+	a, err := NewNodeDaemonWithConfig("127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := NewNodeDaemonWithConfig("127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer b.Close()
+
+	ours, theirs := net.Pipe()
+	go a.handleConnection(ours, BinaryProtocol)
+	go b.handleConnection(theirs, BinaryProtocol)
+
+	// Each node learns the RTT that the other measured
+	deadline := time.Now().Add(10 * time.Second)
+	for _, nd := range []*NodeDaemon{a, b} {
+		peer := a.us
+		if nd == a {
+			peer = b.us
+		}
+
+		for {
+			s, _ := nd.stateOf(peer).([]propagation.LinkState)
+			if len(s) == 1 && s[0].RTT > 0 {
+				break
+			}
+
+			require.True(t, time.Now().Before(deadline))
+			time.Sleep(time.Millisecond)
+		}
+
+		stats := nd.ConnectionStats()
+		require.Len(t, stats, 1)
+		require.True(t, stats[0].RTT > 0)
+	}
+}
+
+// Make two linked daemons, closed when the test ends, and wait until
+// each has computed the cluster of two nodes
+func linkedPair(t *testing.T) (*NodeDaemon, *NodeDaemon) {
+	silenceLogs(t)
+
+	a, err := NewNodeDaemon("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(a.Close)
+	b, err := NewNodeDaemon("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(b.Close)
+
+	ours, theirs := net.Pipe()
+	go a.handleConnection(ours, BinaryProtocol)
+	go b.handleConnection(theirs, BinaryProtocol)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for _, nd := range []*NodeDaemon{a, b} {
+		for len(nd.Members()) < 2 {
+			require.True(t, time.Now().Before(deadline))
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	return a, b
+}
+
+func TestStatus(t *testing.T) {
+	a, _ := linkedPair(t)
+
+	s := a.Status()
+	require.Equal(t, 2, s.Topology.Nodes)
+	require.Equal(t, 1, s.Topology.Diameter)
+	require.Equal(t, 1, s.TreeHeight)
+	var buf bytes.Buffer
+	require.NoError(t, s.Write(&buf))
+	require.Contains(t, buf.String(), "tree: root")
+}
+
+func TestMembers(t *testing.T) {
+	a, b := linkedPair(t)
+
+	members := a.Members()
+	require.Len(t, members, 2)
+	for _, m := range members {
+		require.Len(t, m.Links, 1)
+	}
+
+	neighbors := a.Neighbors()
+	require.Len(t, neighbors, 1)
+	require.Equal(t, b.us, neighbors[0].Node)
+}
+
+func TestTreeInfo(t *testing.T) {
+	a, b := linkedPair(t)
+
+	// The daemons agree about the root, once each has heard the
+	// parent announced by the other
+	deadline := time.Now().Add(10 * time.Second)
+	for a.TreeInfo().Root != b.TreeInfo().Root {
+		require.True(t, time.Now().Before(deadline))
+		time.Sleep(time.Millisecond)
+	}
+
+	root, child := a, b
+	if a.TreeInfo().Root != a.us {
+		root, child = b, a
+	}
+
+	ri := root.TreeInfo()
+	require.Equal(t, root.us, ri.Root)
+	require.Equal(t, NodeID(""), ri.Parent)
+	require.Equal(t, []NodeID{child.us}, ri.Children)
+	require.Equal(t, 0, ri.Depth)
+
+	ci := child.TreeInfo()
+	require.Equal(t, root.us, ci.Parent)
+	require.Empty(t, ci.Children)
+	require.Equal(t, 1, ci.Depth)
+	require.Equal(t, []NodeID{root.us}, ci.Links)
+	require.Equal(t, ri.Root, root.Status().TreeRoot)
+}
+
+func TestExport(t *testing.T) {
+	a, b := linkedPair(t)
+
+	root := a.Status().TreeRoot
+	var buf bytes.Buffer
+	require.NoError(t, a.WriteDOT(&buf))
+	require.Contains(t, buf.String(),
+		fmt.Sprintf("%q [shape=doublecircle];", string(root)))
+	require.Contains(t, buf.String(), string(b.us))
+
+	buf.Reset()
+	require.NoError(t, a.WriteJSON(&buf))
+	require.Contains(t, buf.String(), fmt.Sprintf(`"root":%q`, string(root)))
+	require.Contains(t, buf.String(), string(b.us))
+}
+
+func TestAutoLink(t *testing.T) {
+	silenceLogs(t)
+
+	config := DefaultConfig
+	config.EdgeConnectivity = 2
+	config.AutoLinkInterval = 10 * time.Millisecond
+
+	var nds []*NodeDaemon
+	for i := 0; i < 3; i++ {
+		nd, err := NewNodeDaemonWithConfig("127.0.0.1:0", config)
+		require.NoError(t, err)
+		defer nd.Close()
+		nds = append(nds, nd)
+	}
+
+	addr := func(nd *NodeDaemon) string {
+		return nd.Addrs()[0].String()
+	}
+
+	// Form a path, and tell the end with the lower NodeID the
+	// address of the other
+	require.NoError(t, nds[0].Connect(addr(nds[1])))
+	require.NoError(t, nds[1].Connect(addr(nds[2])))
+	if nds[0].us < nds[2].us {
+		nds[0].SetPeerAddress(nds[2].us, addr(nds[2]))
+	} else {
+		nds[2].SetPeerAddress(nds[0].us, addr(nds[0]))
+	}
+
+	// The ends get linked
+	deadline := time.Now().Add(10 * time.Second)
+	for len(nds[0].ConnectionStats()) < 2 || len(nds[2].ConnectionStats()) < 2 {
+		require.True(t, time.Now().Before(deadline))
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Receive the next event from a membership watcher
+func nextEvent(t *testing.T, events <-chan propagation.MembershipEvent) propagation.MembershipEvent {
+	select {
+	case ev, ok := <-events:
+		require.True(t, ok)
+		return ev
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for a membership event")
+		return propagation.MembershipEvent{}
+	}
+}
+
+func TestWatchMembership(t *testing.T) {
+	silenceLogs(t)
+
+	a, err := NewNodeDaemon("127.0.0.1:0")
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := NewNodeDaemon("127.0.0.1:0")
+	require.NoError(t, err)
+	defer b.Close()
+
+	events, stop, err := a.WatchMembership(0)
+	require.NoError(t, err)
+	defer stop()
+
+	ours, theirs := net.Pipe()
+	go a.handleConnection(ours, BinaryProtocol)
+	go b.handleConnection(theirs, BinaryProtocol)
+
+	joined := make(map[NodeID]bool)
+	for len(joined) < 2 {
+		ev := nextEvent(t, events)
+		require.Equal(t, propagation.NodeJoined, ev.Kind)
+		joined[ev.Node] = true
+	}
+	require.True(t, joined[a.us] && joined[b.us])
+
+	ours.Close()
+	for ev := nextEvent(t, events); ev.Kind != propagation.NodeLeft; ev = nextEvent(t, events) {
+		require.Equal(t, propagation.NodeUnreachable, ev.Kind)
+	}
+
+	// The events are replayed for a later watcher
+	replayed, stop2, err := a.WatchMembership(2)
+	require.NoError(t, err)
+	ev := nextEvent(t, replayed)
+	require.Equal(t, uint64(2), ev.Seq)
+	require.NoError(t, stop2())
+
+	history, err := a.MembershipEvents(0)
+	require.NoError(t, err)
+	require.Equal(t, propagation.NodeLeft, history[len(history)-1].Kind)
+	require.Equal(t, b.us, history[len(history)-1].Node)
+}
+
+func TestMembershipWatcherDropped(t *testing.T) {
+	w := newMembershipWatcher()
+	go w.run()
+
+	// Nothing consumes the events, so the queue fills up
+	var seq uint64
+	for w.push(propagation.MembershipEvent{Seq: seq + 1}) {
+		seq++
+	}
+	require.True(t, seq >= membershipQueueLen)
+
+	// The events queued are delivered, and then the channel is
+	// closed
+	var last uint64
+	for ev := range w.events {
+		require.Equal(t, last+1, ev.Seq)
+		last = ev.Seq
+	}
+	require.Equal(t, seq, last)
+	require.Equal(t, ErrWatcherDropped, w.err())
+}
+
+// Generate membership events on a daemon, through a peer b whose
+// link to a node c comes and goes.  Each cycle after the first causes
+// three events: c becomes unreachable, leaves, and joins again.
+// Returns the sequence number of the last event.
+func churnMembership(nd *NodeDaemon, cycles int) uint64 {
+	var seq uint64
+	nd.call(func() {
+		c := nd.connectivity
+		link := c.Link("b")
+		incoming := func(n NodeID, v propagation.Version, links ...NodeID) {
+			var state []propagation.LinkState
+			for _, l := range links {
+				state = append(state, propagation.LinkState{Node: l})
+			}
+			link.Incoming(c.ConnectivityPropagation(),
+				[]propagation.Update{{Node: n, Version: v, State: state}})
+			c.Recompute()
+		}
+
+		for i := 0; i < cycles; i++ {
+			v := propagation.Version(2*i + 1)
+			incoming("b", v, nd.us, "c")
+			incoming("c", v, "b")
+			incoming("c", v+1)
+			incoming("b", v+1, nd.us)
+		}
+
+		seq = c.MembershipSeq()
+	})
+	return seq
+}
+
+func TestWatchMembershipReplayTooLong(t *testing.T) {
+	config := DefaultConfig
+	config.Connectivity.MembershipHistory = 2 * membershipQueueLen
+	nd, err := NewNodeDaemonWithConfig("127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer nd.Close()
+
+	seq := churnMembership(nd, membershipQueueLen/3+10)
+	require.True(t, seq > membershipQueueLen)
+
+	_, _, err = nd.WatchMembership(0)
+	require.Equal(t, ErrReplayTooLong, err)
+
+	// A replay that fits is delivered in full
+	from := seq - membershipQueueLen + 1
+	events, stop, err := nd.WatchMembership(from)
+	require.NoError(t, err)
+	defer stop()
+	for i := from; i <= seq; i++ {
+		require.Equal(t, i, nextEvent(t, events).Seq)
+	}
+}
+
+func TestWatchMembershipClosed(t *testing.T) {
+	nd, err := NewNodeDaemon("127.0.0.1:0")
+	require.NoError(t, err)
+	nd.Close()
+
+	_, _, err = nd.WatchMembership(0)
+	require.Equal(t, ErrClosed, err)
+}
+
+func TestWatchMembershipFuture(t *testing.T) {
+	nd, err := NewNodeDaemon("127.0.0.1:0")
+	require.NoError(t, err)
+	defer nd.Close()
+
+	_, _, err = nd.WatchMembership(1000)
+	require.Error(t, err)
+}
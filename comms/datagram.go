@@ -0,0 +1,178 @@
+package comms
+
+import (
+	"errors"
+	"fmt"
+
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+// Datagrams are forwarded hop by hop along shortest paths in the
+// graph of the cluster, as each node sees it.  Delivery is not
+// guaranteed: A datagram can be lost when a connection fails.  But if
+// a node cannot forward a datagram because it has no route to the
+// destination, because the datagram has crossed too many links, or
+// because the connection to the next hop is falling behind, the
+// datagram is returned to its source, where it is passed to the
+// function given to SetUnreachableFunc.
+//
+// The source of a datagram is as given by the node that sent it, and
+// is not checked.  So a node can direct returned datagrams at another
+// node by naming it as the source.
+
+var (
+	ErrNoRoute          = errors.New("no route to destination")
+	ErrHopLimit         = errors.New("hop limit exceeded")
+	ErrQueueFull        = errors.New("datagram queue full")
+	ErrDatagramTooLarge = fmt.Errorf("datagram payload exceeds %d bytes", maxDatagramPayload)
+)
+
+// The statuses of returned datagrams, and the routing errors that
+// they report
+var datagramErrors = []struct {
+	status datagramStatus
+	err    error
+}{
+	{datagramNoRoute, ErrNoRoute},
+	{datagramHopLimit, ErrHopLimit},
+	{datagramQueueFull, ErrQueueFull},
+}
+
+// The error reported by a returned datagram with status s
+func (s datagramStatus) err() error {
+	for _, de := range datagramErrors {
+		if de.status == s {
+			return de.err
+		}
+	}
+
+	return fmt.Errorf("datagram returned with %s", s)
+}
+
+// The status with which a datagram is returned when routing fails
+// with err
+func returnStatus(err error) (datagramStatus, bool) {
+	for _, de := range datagramErrors {
+		if de.err == err {
+			return de.status, true
+		}
+	}
+
+	return datagramData, false
+}
+
+const (
+	maxDatagramPayload = 1<<16 - 1
+
+	// The number of datagrams that can be queued for a connection
+	datagramQueueLen = 100
+)
+
+// Send a datagram to the given node.  An error is returned if this
+// node cannot forward it, or ErrClosed if the daemon is closed.
+// Failures further on are reported to the function given to
+// SetUnreachableFunc.
+func (nd *NodeDaemon) Send(dest NodeID, payload []byte) error {
+	if len(payload) > maxDatagramPayload {
+		return ErrDatagramTooLarge
+	}
+
+	d := datagram{
+		source:  nd.us,
+		dest:    dest,
+		hops:    byte(nd.config.DatagramHopLimit),
+		payload: append([]byte(nil), payload...),
+	}
+
+	err := ErrClosed
+	nd.call(func() {
+		if !nd.closed {
+			err = nd.route(d)
+		}
+	})
+
+	return err
+}
+
+// Call f with the source and payload of each datagram delivered to
+// this node.  f is called from the event loop, so it must not block
+// or call other methods of the daemon.
+func (nd *NodeDaemon) SetDatagramFunc(f func(source NodeID, payload []byte)) {
+	nd.call(func() { nd.onDatagram = f })
+}
+
+// Call f with the destination and payload of each datagram sent from
+// this node that another node could not forward, and the reason.  f
+// is called from the event loop, so it must not block or call other
+// methods of the daemon.
+func (nd *NodeDaemon) SetUnreachableFunc(f func(dest NodeID, payload []byte, err error)) {
+	nd.call(func() { nd.onUnreachable = f })
+}
+
+// Deliver a datagram, or pass it to the next hop towards its
+// destination.  Called on the event loop.
+func (nd *NodeDaemon) route(d datagram) error {
+	to := d.to()
+	if to == nd.us {
+		nd.deliver(d)
+		return nil
+	}
+
+	if d.hops == 0 {
+		return ErrHopLimit
+	}
+
+	// A neighbor is reachable directly, even before the graph
+	// reflects the link
+	c := nd.connectionTo(to)
+	if c == nil {
+		if next, ok := nd.connectivity.NextHop(to); ok {
+			c = nd.connectionTo(next)
+		}
+	}
+
+	if c == nil {
+		return ErrNoRoute
+	}
+
+	d.hops--
+	select {
+	case c.datagrams <- d:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Handle a datagram received from a peer.  Called on the event loop.
+func (nd *NodeDaemon) forward(d datagram) {
+	err := nd.route(d)
+	if err == nil || d.status != datagramData {
+		// Returned datagrams that cannot be routed are dropped
+		return
+	}
+
+	status, ok := returnStatus(err)
+	if !ok {
+		return
+	}
+
+	d.status = status
+	d.hops = byte(nd.config.DatagramHopLimit)
+	nd.route(d)
+}
+
+// Called on the event loop
+func (nd *NodeDaemon) deliver(d datagram) {
+	switch d.status {
+	case datagramData:
+		if nd.onDatagram != nil {
+			nd.onDatagram(d.source, d.payload)
+		}
+
+	default:
+		if nd.onUnreachable != nil {
+			nd.onUnreachable(d.dest, d.payload, d.status.err())
+		}
+	}
+}
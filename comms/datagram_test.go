@@ -0,0 +1,144 @@
+package comms
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+func TestDatagrams(t *testing.T) {
+	silenceLogs(t)
+
+	config := DefaultConfig
+	config.DatagramHopLimit = 2
+	c, err := NewCluster(4, config, NewFaultInjector(Faults{}, 1))
+	require.NoError(t, err)
+	defer c.Close()
+
+	// A path
+	for i := 1; i < len(c.Nodes); i++ {
+		c.Link(i-1, i)
+	}
+	waitForConvergence(t, c)
+
+	type received struct {
+		node    NodeID
+		payload string
+		err     error
+	}
+	got := make(chan received, 10)
+	for _, nd := range c.Nodes {
+		nd.SetDatagramFunc(func(source NodeID, payload []byte) {
+			got <- received{source, string(payload), nil}
+		})
+		nd.SetUnreachableFunc(func(dest NodeID, payload []byte, err error) {
+			got <- received{dest, string(payload), err}
+		})
+	}
+
+	a, b := c.Nodes[0], c.Nodes[2]
+	require.NoError(t, a.Send(b.us, []byte("hello")))
+	require.Equal(t, received{a.us, "hello", nil}, <-got)
+	require.NoError(t, b.Send(a.us, []byte("reply")))
+	require.Equal(t, received{b.us, "reply", nil}, <-got)
+
+	// The last node is beyond the hop limit
+	far := c.Nodes[3].us
+	require.NoError(t, a.Send(far, []byte("far")))
+	require.Equal(t, received{far, "far", ErrHopLimit}, <-got)
+
+	require.Equal(t, ErrNoRoute, a.Send("nowhere", nil))
+	require.Equal(t, ErrDatagramTooLarge, a.Send(far, make([]byte, 1<<16)))
+}
+
+func TestDatagramNoRoute(t *testing.T) {
+	silenceLogs(t)
+
+	nd, err := NewNodeDaemon("127.0.0.1:0")
+	require.NoError(t, err)
+	defer nd.Close()
+
+	// A datagram from a JSON peer to an unknown node comes back
+	ours, theirs := net.Pipe()
+	go nd.handleConnection(ours, JSONProtocol)
+	w := newJSONWriter(theirs)
+	go func() {
+		w.writeHello(hello{protocolVersion, "peer", nd.hello().policy})
+		w.writeDatagram(datagram{source: "peer", dest: "nowhere",
+			hops: 5, payload: []byte("lost")})
+	}()
+
+	r := newJSONReader(theirs)
+	_, err = r.readHello()
+	require.NoError(t, err)
+	for {
+		msg, err := r.readMessage()
+		require.NoError(t, err)
+		if msg.kind == datagramMessage {
+			require.Equal(t, datagram{source: "peer", dest: "nowhere",
+				hops: 15, status: datagramNoRoute,
+				payload: []byte("lost")}, msg.datagram)
+			break
+		}
+	}
+}
+
+func TestDatagramQueueFull(t *testing.T) {
+	silenceLogs(t)
+
+	nd, err := NewNodeDaemon("127.0.0.1:0")
+	require.NoError(t, err)
+	defer nd.Close()
+
+	// A peer that never reads, so that datagrams to it queue up
+	ours, theirs := net.Pipe()
+	go nd.handleConnection(ours, JSONProtocol)
+	go newJSONWriter(theirs).writeHello(hello{protocolVersion, "peer", nd.hello().policy})
+	deadline := time.Now().Add(10 * time.Second)
+	for len(nd.ConnectionStats()) == 0 {
+		require.True(t, time.Now().Before(deadline))
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < datagramQueueLen; i++ {
+		require.NoError(t, nd.Send("peer", nil))
+	}
+	require.Equal(t, ErrQueueFull, nd.Send("peer", nil))
+}
+
+func TestDatagramSendClosed(t *testing.T) {
+	nd, err := NewNodeDaemon("127.0.0.1:0")
+	require.NoError(t, err)
+	nd.Close()
+	require.Equal(t, ErrClosed, nd.Send(nd.us, nil))
+}
+
+func TestDatagramHopLimitConfig(t *testing.T) {
+	config := DefaultConfig
+	config.DatagramHopLimit = 0
+	nd, err := NewNodeDaemonWithConfig("127.0.0.1:0", config)
+	require.NoError(t, err)
+	require.Equal(t, DefaultConfig.DatagramHopLimit, nd.config.DatagramHopLimit)
+	nd.Close()
+
+	config.DatagramHopLimit = 256
+	_, err = NewNodeDaemonWithConfig("127.0.0.1:0", config)
+	require.Error(t, err)
+}
+
+// Each routing error maps to a status that reports it
+func TestDatagramStatuses(t *testing.T) {
+	for _, err := range []error{ErrNoRoute, ErrHopLimit, ErrQueueFull} {
+		status, ok := returnStatus(err)
+		require.True(t, ok)
+		require.NotEqual(t, datagramData, status)
+		require.Equal(t, err, status.err())
+	}
+
+	_, ok := returnStatus(ErrDatagramTooLarge)
+	require.False(t, ok)
+}
@@ -0,0 +1,98 @@
+package comms
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dpw/monotreme/propagation"
+)
+
+// Decode a byte stream captured from one direction of a connection
+// using the binary protocol, and describe each message in readable
+// form.  Messages are prefixed with their offset in the stream, so
+// that a framing problem can be located in the capture.  Returns nil
+// if the stream ends cleanly at a message boundary.
+func Decode(in io.Reader, out io.Writer) error {
+	r := newReader(in)
+
+	fail := func(start int64, what string) error {
+		return fmt.Errorf("offset %d: %s: %v", start, what, r.err)
+	}
+
+	trailer := func() error {
+		start := r.offset
+		counter := r.counter
+		if r.endMessage() != nil {
+			return fail(start, "message trailer")
+		}
+
+		fmt.Fprintf(out, "%d: trailer %02x ok\n", start, counter)
+		return nil
+	}
+
+	start := r.offset
+	h := readHello(r)
+	if r.err != nil {
+		return fail(start, "hello message")
+	}
+
+	if h.version != protocolVersion {
+		return fmt.Errorf("offset %d: hello message: protocol version %d, but we speak %d",
+			start, h.version, protocolVersion)
+	}
+
+	fmt.Fprintf(out, "%d: hello from node %s with tree policy %s\n",
+		start, h.node, h.policy)
+	if err := trailer(); err != nil {
+		return err
+	}
+
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			return nil
+		}
+
+		start = r.offset
+		msg := readMessageBody(r)
+		if r.err != nil {
+			return fail(start, "message")
+		}
+
+		switch msg.kind {
+		case updatesMessage:
+			fmt.Fprintf(out, "%d: %d updates\n", start,
+				len(msg.updates))
+			for _, u := range msg.updates {
+				fmt.Fprintf(out, "    node %s version %d state %s\n",
+					u.Node, u.Version,
+					formatLinkStates(u.State.([]propagation.LinkState)))
+			}
+		case datagramMessage:
+			d := msg.datagram
+			fmt.Fprintf(out, "%d: datagram %s from %s to %s, %d hops left, %d bytes\n",
+				start, d.status, d.source, d.dest, d.hops,
+				len(d.payload))
+		default:
+			fmt.Fprintf(out, "%d: %s %d\n", start, msg.kind, msg.stamp)
+		}
+
+		if err := trailer(); err != nil {
+			return err
+		}
+	}
+}
+
+// Format the links of a connectivity state, e.g. "[b/1.5ms
+// c/0s/parent]"
+func formatLinkStates(state []propagation.LinkState) string {
+	links := make([]string, len(state))
+	for i, ls := range state {
+		links[i] = fmt.Sprintf("%s/%v", ls.Node, ls.RTT)
+		if ls.Parent {
+			links[i] += "/parent"
+		}
+	}
+
+	return "[" + strings.Join(links, " ") + "]"
+}
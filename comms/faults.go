@@ -0,0 +1,233 @@
+package comms
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Faults to inject into connections, to test how daemons behave on
+// bad networks.  The probabilities apply to each write.
+type Faults struct {
+	// Delay each write by Latency plus a random duration of up to
+	// Jitter
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Throttle writes to this many bytes per second.  Zero means
+	// unlimited.
+	Bandwidth int
+
+	// The probability that a write drops the connection
+	Drop float64
+
+	// The probability that a write has one of its bytes corrupted
+	Corrupt float64
+
+	// The probability that a write leaves the connection
+	// half-open: From then on, writes block until the write
+	// deadline, and nothing more is read from the peer.
+	Stall float64
+}
+
+// Counts of the faults injected
+type FaultStats struct {
+	Writes      uint64
+	Drops       uint64
+	Corruptions uint64
+	Stalls      uint64
+}
+
+var errDropped = errors.New("connection dropped by fault injection")
+
+// A FaultInjector applies Faults to the connections it wraps.  The
+// faults can be changed at any time, and apply to the subsequent
+// writes on all wrapped connections.
+type FaultInjector struct {
+	lock   sync.Mutex
+	faults Faults
+	rng    *rand.Rand
+	stats  FaultStats
+}
+
+func NewFaultInjector(faults Faults, seed int64) *FaultInjector {
+	return &FaultInjector{faults: faults, rng: rand.New(rand.NewSource(seed))}
+}
+
+func (fi *FaultInjector) SetFaults(faults Faults) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.faults = faults
+}
+
+func (fi *FaultInjector) Stats() FaultStats {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	return fi.stats
+}
+
+// The faults to inject into a write of n bytes
+type writeFaults struct {
+	delay time.Duration
+	drop  bool
+	stall bool
+
+	// The index of the byte to corrupt, or -1, and the bits to
+	// flip
+	corruptAt   int
+	corruptBits byte
+}
+
+func (fi *FaultInjector) decide(n int) writeFaults {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+
+	f := &fi.faults
+	wf := writeFaults{delay: f.Latency, corruptAt: -1}
+	fi.stats.Writes++
+
+	if f.Jitter > 0 {
+		wf.delay += time.Duration(fi.rng.Int63n(int64(f.Jitter)))
+	}
+
+	if f.Bandwidth > 0 {
+		wf.delay += time.Duration(n) * time.Second /
+			time.Duration(f.Bandwidth)
+	}
+
+	switch {
+	case fi.rng.Float64() < f.Drop:
+		wf.drop = true
+		fi.stats.Drops++
+	case fi.rng.Float64() < f.Stall:
+		wf.stall = true
+		fi.stats.Stalls++
+	case n > 0 && fi.rng.Float64() < f.Corrupt:
+		wf.corruptAt = fi.rng.Intn(n)
+		wf.corruptBits = byte(1 + fi.rng.Intn(255))
+		fi.stats.Corruptions++
+	}
+
+	return wf
+}
+
+// Wrap a connection so that writes to it suffer the injected faults
+func (fi *FaultInjector) Wrap(conn net.Conn) net.Conn {
+	return &faultyConn{Conn: conn, fi: fi, closed: make(chan struct{})}
+}
+
+type faultyConn struct {
+	net.Conn
+	fi *FaultInjector
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	lock          sync.Mutex
+	stalled       bool
+	writeDeadline time.Time
+}
+
+func (c *faultyConn) Write(p []byte) (int, error) {
+	wf := c.fi.decide(len(p))
+	if wf.stall {
+		c.lock.Lock()
+		c.stalled = true
+		c.lock.Unlock()
+	}
+
+	if c.isStalled() {
+		return 0, c.wait(-1)
+	}
+
+	if wf.drop {
+		c.Close()
+		return 0, errDropped
+	}
+
+	if wf.delay > 0 {
+		if err := c.wait(wf.delay); err != nil {
+			return 0, err
+		}
+	}
+
+	if wf.corruptAt >= 0 {
+		p = append([]byte(nil), p...)
+		p[wf.corruptAt] ^= wf.corruptBits
+	}
+
+	return c.Conn.Write(p)
+}
+
+func (c *faultyConn) isStalled() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stalled
+}
+
+// Delay a write, or block it for good if delay is negative, as for a
+// stalled connection.  Like a real write, it fails if the write
+// deadline passes or the connection is closed first.
+func (c *faultyConn) wait(delay time.Duration) error {
+	c.lock.Lock()
+	deadline := c.writeDeadline
+	c.lock.Unlock()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var done <-chan time.Time
+	if delay >= 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		done = timer.C
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+func (c *faultyConn) Read(p []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(p)
+		if err != nil || !c.isStalled() {
+			return n, err
+		}
+
+		// Discard what the peer sends to a stalled connection
+	}
+}
+
+func (c *faultyConn) SetDeadline(t time.Time) error {
+	c.setWriteDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *faultyConn) SetWriteDeadline(t time.Time) error {
+	c.setWriteDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *faultyConn) setWriteDeadline(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeDeadline = t
+}
+
+func (c *faultyConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
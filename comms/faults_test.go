@@ -0,0 +1,115 @@
+package comms
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCorruption(t *testing.T) {
+	for seed := int64(0); seed < 10; seed++ {
+		fi := NewFaultInjector(Faults{Corrupt: 0.2}, seed)
+		ours, theirs := net.Pipe()
+		w := newWriter(fi.Wrap(ours))
+		go func() {
+			for stamp := int64(1); w.writePing(stamp) == nil; stamp++ {
+			}
+		}()
+
+		// The checksum in the trailer catches a corrupted
+		// ping, so every message read is the ping sent
+		r := newReader(theirs)
+		var err error
+		for stamp := int64(1); err == nil; stamp++ {
+			require.True(t, stamp < 1000)
+			var msg message
+			msg, err = r.readMessage()
+			if err == nil {
+				require.Equal(t, message{kind: pingMessage, stamp: stamp}, msg)
+			}
+		}
+
+		require.True(t, fi.Stats().Corruptions > 0)
+		theirs.Close()
+	}
+}
+
+// A throttled write fails when the write deadline passes, as it
+// would on a real connection
+func TestThrottledWriteDeadline(t *testing.T) {
+	fi := NewFaultInjector(Faults{Latency: time.Minute}, 1)
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	conn := fi.Wrap(ours)
+	defer conn.Close()
+	go io.Copy(io.Discard, theirs)
+
+	start := time.Now()
+	require.NoError(t, conn.SetWriteDeadline(start.Add(10*time.Millisecond)))
+	_, err := conn.Write([]byte("x"))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.True(t, time.Since(start) < time.Minute)
+
+	// Without a deadline, the delay passes
+	fi = NewFaultInjector(Faults{Latency: time.Millisecond}, 1)
+	conn = fi.Wrap(ours)
+	require.NoError(t, conn.SetWriteDeadline(time.Time{}))
+	_, err = conn.Write([]byte("x"))
+	require.NoError(t, err)
+}
+
+func waitForConvergence(t *testing.T, c *Cluster) {
+	deadline := time.Now().Add(20 * time.Second)
+	for !c.Converged() {
+		require.True(t, time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterFaults(t *testing.T) {
+	silenceLogs(t)
+
+	config := DefaultConfig
+	config.WriteTimeout = 100 * time.Millisecond
+	config.PingInterval = 10 * time.Millisecond
+	config.RecomputeDelay = time.Millisecond
+
+	fi := NewFaultInjector(Faults{
+		Latency:   time.Millisecond,
+		Jitter:    time.Millisecond,
+		Bandwidth: 1 << 20,
+		Drop:      0.02,
+		Corrupt:   0.02,
+		Stall:     0.02,
+	}, 1)
+
+	c, err := NewCluster(6, config, fi)
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := range c.Nodes {
+		c.Link(i, (i+1)%len(c.Nodes))
+	}
+	c.Link(0, 3)
+
+	time.Sleep(500 * time.Millisecond)
+	stats := fi.Stats()
+	require.True(t, stats.Drops > 0)
+	require.True(t, stats.Corruptions > 0)
+	require.True(t, stats.Stalls > 0)
+
+	// Without faults, the links recover
+	fi.SetFaults(Faults{})
+	waitForConvergence(t, c)
+
+	c.Partition([]int{0, 1, 2})
+	waitForConvergence(t, c)
+	require.Equal(t, 3, c.Nodes[0].Status().Topology.Nodes)
+
+	c.Heal()
+	waitForConvergence(t, c)
+}
@@ -0,0 +1,233 @@
+package comms
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dpw/monotreme/propagation"
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+// The JSON protocol sends each message as a single line containing a
+// JSON object, e.g.
+//
+//	{"type":"hello","version":1,"node":"a1b2c3","policy":"bushy(witnesses=10,limit=4,margin=1)+incremental"}
+//	{"type":"updates","updates":[{"node":"a1b2c3","version":3,"state":[{"node":"d4e5f6","rtt":250000}]}]}
+//	{"type":"ping","stamp":1000000}
+//	{"type":"datagram","source":"a1b2c3","dest":"d4e5f6","hops":15,"payload":"aGVsbG8="}
+//
+// The version and policy in the hello must match the daemon's own, so
+// copy them from the hello that the daemon sends when the connection
+// opens.
+// RTTs are in nanoseconds, and a link to the node's parent in the
+// incremental spanning tree has "parent":true.  Datagram payloads are
+// base64-encoded, and a datagram returned to its source has a
+// "status" of "no-route", "hop-limit" or "queue-full".  Nodes do not
+// send pings over JSON connections, but they do reply to them.
+
+const jsonHello = "hello"
+
+type jsonMessage struct {
+	Type    string       `json:"type"`
+	Version byte         `json:"version,omitempty"`
+	Node    NodeID       `json:"node,omitempty"`
+	Policy  string       `json:"policy,omitempty"`
+	Updates []jsonUpdate `json:"updates,omitempty"`
+	Stamp   int64        `json:"stamp,omitempty"`
+
+	Source  NodeID `json:"source,omitempty"`
+	Dest    NodeID `json:"dest,omitempty"`
+	Hops    byte   `json:"hops,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+}
+
+type jsonUpdate struct {
+	Node    NodeID              `json:"node"`
+	Version propagation.Version `json:"version"`
+	State   []jsonLinkState     `json:"state"`
+}
+
+type jsonLinkState struct {
+	Node   NodeID        `json:"node"`
+	RTT    time.Duration `json:"rtt"`
+	Parent bool          `json:"parent,omitempty"`
+}
+
+type jsonWriter struct {
+	enc *json.Encoder
+}
+
+func newJSONWriter(w io.Writer) *jsonWriter {
+	// json.Encoder terminates each value with a newline
+	return &jsonWriter{json.NewEncoder(w)}
+}
+
+func (w *jsonWriter) writeHello(h hello) error {
+	return w.enc.Encode(jsonMessage{
+		Type:    jsonHello,
+		Version: h.version,
+		Node:    h.node,
+		Policy:  h.policy,
+	})
+}
+
+func (w *jsonWriter) writeUpdates(updates []propagation.Update) error {
+	msg := jsonMessage{
+		Type:    updatesMessage.String(),
+		Updates: make([]jsonUpdate, len(updates)),
+	}
+
+	for i, u := range updates {
+		msg.Updates[i] = newJSONUpdate(u)
+	}
+
+	return w.enc.Encode(msg)
+}
+
+func newJSONUpdate(u propagation.Update) jsonUpdate {
+	state := u.State.([]propagation.LinkState)
+	ju := jsonUpdate{
+		Node:    u.Node,
+		Version: u.Version,
+		State:   make([]jsonLinkState, len(state)),
+	}
+
+	for i, ls := range state {
+		ju.State[i] = jsonLinkState(ls)
+	}
+
+	return ju
+}
+
+// The size of the JSON encoding of an update within an updates
+// message, including the separating comma
+func jsonUpdateSize(u propagation.Update) int {
+	bs, err := json.Marshal(newJSONUpdate(u))
+	if err != nil {
+		panic(err)
+	}
+
+	return len(bs) + 1
+}
+
+func (w *jsonWriter) writePing(stamp int64) error {
+	return w.enc.Encode(jsonMessage{
+		Type:  pingMessage.String(),
+		Stamp: stamp,
+	})
+}
+
+func (w *jsonWriter) writePong(stamp int64) error {
+	return w.enc.Encode(jsonMessage{
+		Type:  pongMessage.String(),
+		Stamp: stamp,
+	})
+}
+
+func (w *jsonWriter) writeDatagram(d datagram) error {
+	msg := jsonMessage{
+		Type:    datagramMessage.String(),
+		Source:  d.source,
+		Dest:    d.dest,
+		Hops:    d.hops,
+		Payload: d.payload,
+	}
+
+	if d.status != datagramData {
+		msg.Status = d.status.String()
+	}
+
+	return w.enc.Encode(msg)
+}
+
+type jsonReader struct {
+	dec *json.Decoder
+}
+
+func newJSONReader(r io.Reader) *jsonReader {
+	return &jsonReader{json.NewDecoder(r)}
+}
+
+func (r *jsonReader) readHello() (hello, error) {
+	var msg jsonMessage
+	if err := r.dec.Decode(&msg); err != nil {
+		return hello{}, err
+	}
+
+	if msg.Type != jsonHello {
+		return hello{}, fmt.Errorf("expected %s message, got %q",
+			jsonHello, msg.Type)
+	}
+
+	if msg.Node == "" {
+		return hello{}, fmt.Errorf("hello message lacks node")
+	}
+
+	return hello{version: msg.Version, node: msg.Node, policy: msg.Policy}, nil
+}
+
+func (r *jsonReader) readMessage() (message, error) {
+	var msg jsonMessage
+	if err := r.dec.Decode(&msg); err != nil {
+		return message{}, err
+	}
+
+	switch msg.Type {
+	case updatesMessage.String():
+		updates := make([]propagation.Update, len(msg.Updates))
+		for i, u := range msg.Updates {
+			state := make([]propagation.LinkState, len(u.State))
+			for j, ls := range u.State {
+				state[j] = propagation.LinkState(ls)
+			}
+
+			updates[i] = propagation.Update{
+				Node:    u.Node,
+				Version: u.Version,
+				State:   state,
+			}
+		}
+
+		return message{kind: updatesMessage, updates: updates}, nil
+
+	case pingMessage.String():
+		return message{kind: pingMessage, stamp: msg.Stamp}, nil
+
+	case pongMessage.String():
+		return message{kind: pongMessage, stamp: msg.Stamp}, nil
+
+	case datagramMessage.String():
+		d := datagram{
+			source:  msg.Source,
+			dest:    msg.Dest,
+			hops:    msg.Hops,
+			payload: msg.Payload,
+		}
+
+		switch msg.Status {
+		case "":
+		case datagramNoRoute.String():
+			d.status = datagramNoRoute
+		case datagramHopLimit.String():
+			d.status = datagramHopLimit
+		case datagramQueueFull.String():
+			d.status = datagramQueueFull
+		default:
+			return message{}, fmt.Errorf("unknown datagram status %q",
+				msg.Status)
+		}
+
+		if len(d.payload) > maxDatagramPayload {
+			return message{}, ErrDatagramTooLarge
+		}
+
+		return message{kind: datagramMessage, datagram: d}, nil
+
+	default:
+		return message{}, fmt.Errorf("unexpected message type %q",
+			msg.Type)
+	}
+}
@@ -0,0 +1,170 @@
+package comms
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/dpw/monotreme/propagation"
+)
+
+// The most membership events that can be waiting for the consumer of
+// a watcher
+const membershipQueueLen = 1000
+
+var ErrWatcherDropped = errors.New("membership watcher dropped because its consumer fell behind")
+
+var ErrReplayTooLong = fmt.Errorf("membership replay exceeds the watcher queue of %d events", membershipQueueLen)
+
+// A membershipWatcher queues membership events from the event loop,
+// and a goroutine sends them on its channel, so that a slow consumer
+// does not hold up the event loop.
+type membershipWatcher struct {
+	lock     sync.Mutex
+	queue    []propagation.MembershipEvent
+	dropped  bool
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	events   chan propagation.MembershipEvent
+}
+
+func newMembershipWatcher() *membershipWatcher {
+	return &membershipWatcher{
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		events: make(chan propagation.MembershipEvent),
+	}
+}
+
+// Queue an event.  If the queue is full, the watcher is dropped
+// instead: The events already queued are sent, and then the channel
+// is closed.  Returns false if the watcher has been dropped.
+func (w *membershipWatcher) push(ev propagation.MembershipEvent) bool {
+	w.lock.Lock()
+	if len(w.queue) < membershipQueueLen {
+		w.queue = append(w.queue, ev)
+	} else {
+		w.dropped = true
+	}
+	dropped := w.dropped
+	w.lock.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+
+	return !dropped
+}
+
+// Stop the goroutine, which closes the channel
+func (w *membershipWatcher) close() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// ErrWatcherDropped if the watcher was dropped, otherwise nil
+func (w *membershipWatcher) err() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.dropped {
+		return ErrWatcherDropped
+	}
+
+	return nil
+}
+
+func (w *membershipWatcher) run() {
+	defer close(w.events)
+
+	for {
+		w.lock.Lock()
+		queue, dropped := w.queue, w.dropped
+		w.queue = nil
+		w.lock.Unlock()
+
+		for _, ev := range queue {
+			select {
+			case w.events <- ev:
+			case <-w.stop:
+				return
+			}
+		}
+
+		if dropped {
+			return
+		}
+
+		select {
+		case <-w.wake:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Called on the event loop
+func (nd *NodeDaemon) membershipEvent(ev propagation.MembershipEvent) {
+	for w := range nd.watchers {
+		if !w.push(ev) {
+			delete(nd.watchers, w)
+		}
+	}
+}
+
+// Get the retained membership events, from the given sequence
+// number onwards.  See Connectivity.MembershipEvents.
+func (nd *NodeDaemon) MembershipEvents(from uint64) ([]propagation.MembershipEvent, error) {
+	var res []propagation.MembershipEvent
+	var err error
+	nd.call(func() { res, err = nd.connectivity.MembershipEvents(from) })
+	return res, err
+}
+
+// Watch the membership of the cluster.  The retained events from the
+// given sequence number onwards are replayed, as for
+// MembershipEvents, and subsequent events follow, until stop is
+// called and the channel is closed.
+//
+// If the consumer falls behind, so that too many events are waiting
+// for it, the watcher is dropped: The channel is closed after the
+// events already queued, and stop returns ErrWatcherDropped.  The
+// consumer can catch up from the event after the last one it
+// received, with MembershipEvents or another watcher.
+//
+// The replayed events must fit in the queue, so if there are more of
+// them than a watcher can queue, WatchMembership returns
+// ErrReplayTooLong, and the consumer should catch up with
+// MembershipEvents before watching.  On a closed daemon, it returns
+// ErrClosed.
+func (nd *NodeDaemon) WatchMembership(from uint64) (events <-chan propagation.MembershipEvent, stop func() error, err error) {
+	w := newMembershipWatcher()
+	err = ErrClosed
+	nd.call(func() {
+		if nd.closed {
+			return
+		}
+
+		w.queue, err = nd.connectivity.MembershipEvents(from)
+		if err == nil && len(w.queue) > membershipQueueLen {
+			err = ErrReplayTooLong
+		}
+		if err == nil {
+			nd.watchers[w] = struct{}{}
+		}
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	go w.run()
+
+	stop = func() error {
+		w.close()
+		nd.post(func() { delete(nd.watchers, w) })
+		return w.err()
+	}
+
+	return w.events, stop, nil
+}
@@ -4,8 +4,11 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"reflect"
+	"time"
 
 	"github.com/dpw/monotreme/propagation"
 	. "github.com/dpw/monotreme/rudiments"
@@ -13,14 +16,207 @@ import (
 
 var end = binary.LittleEndian
 
+// A Protocol selects the encoding of the messages exchanged on a
+// connection.
+type Protocol int
+
+const (
+	// The compact binary encoding spoken between nodes.
+	BinaryProtocol Protocol = iota
+
+	// A text encoding with one JSON object per line.  It is
+	// intended for debugging: it lets an engineer watch and inject
+	// updates with netcat.
+	JSONProtocol
+)
+
+// The size in bytes of an updates message carrying the given updates
+// in the protocol.
+func (p Protocol) UpdatesMessageSize(updates []propagation.Update) int {
+	if p != JSONProtocol {
+		return updatesMessageSize(updates)
+	}
+
+	cw := &countingWriter{Writer: io.Discard}
+	newJSONWriter(cw).writeUpdates(updates)
+	return int(cw.count)
+}
+
+// The size in bytes of an update within an updates message in the
+// protocol
+func (p Protocol) updateSize(u propagation.Update) int {
+	if p != JSONProtocol {
+		return updateSize(u)
+	}
+
+	return jsonUpdateSize(u)
+}
+
+func (p Protocol) String() string {
+	switch p {
+	case BinaryProtocol:
+		return "binary"
+	case JSONProtocol:
+		return "json"
+	default:
+		return fmt.Sprintf("Protocol(%d)", int(p))
+	}
+}
+
+// The messages of the protocol, independent of their encoding.  The
+// hello message is followed by any number of update, ping and pong
+// messages.
+type messageWriter interface {
+	writeHello(hello) error
+	writeUpdates([]propagation.Update) error
+	writePing(stamp int64) error
+	writePong(stamp int64) error
+	writeDatagram(datagram) error
+}
+
+type messageReader interface {
+	readHello() (hello, error)
+	readMessage() (message, error)
+}
+
+// The version of the protocol.  It changes whenever the encoding of
+// the messages changes, so that nodes that cannot understand each
+// other refuse to link with a clear error, rather than failing on the
+// first message they cannot parse.
+const protocolVersion = 1
+
+// The hello message carries the protocol version, the NodeID of the
+// sender, and the name of its tree policy.  The version and the
+// policy must match ours.
+type hello struct {
+	version byte
+	node    NodeID
+	policy  string
+}
+
+// The kinds of message that follow the hello message
+type messageKind byte
+
+const (
+	updatesMessage messageKind = iota
+	pingMessage
+	pongMessage
+	datagramMessage
+)
+
+func (k messageKind) String() string {
+	switch k {
+	case updatesMessage:
+		return "updates"
+	case pingMessage:
+		return "ping"
+	case pongMessage:
+		return "pong"
+	case datagramMessage:
+		return "datagram"
+	default:
+		return fmt.Sprintf("messageKind(%d)", byte(k))
+	}
+}
+
+// A message following the hello message.  A ping carries a stamp
+// chosen by its sender, which the pong sent in reply echoes, so that
+// the sender of the ping can measure the round-trip time.
+type message struct {
+	kind     messageKind
+	updates  []propagation.Update
+	stamp    int64
+	datagram datagram
+}
+
+// A datagram routed hop by hop from its source to its destination.
+// If it cannot be delivered, it is returned to its source with a
+// status saying why.
+type datagram struct {
+	source, dest NodeID
+
+	// The number of further links the datagram may cross
+	hops byte
+
+	status  datagramStatus
+	payload []byte
+}
+
+type datagramStatus byte
+
+const (
+	// A datagram on its way to its destination
+	datagramData datagramStatus = iota
+
+	// A datagram being returned to its source
+	datagramNoRoute
+	datagramHopLimit
+	datagramQueueFull
+)
+
+func (s datagramStatus) String() string {
+	switch s {
+	case datagramData:
+		return "data"
+	case datagramNoRoute:
+		return "no-route"
+	case datagramHopLimit:
+		return "hop-limit"
+	case datagramQueueFull:
+		return "queue-full"
+	default:
+		return fmt.Sprintf("datagramStatus(%d)", byte(s))
+	}
+}
+
+// The node a datagram is heading for
+func (d datagram) to() NodeID {
+	if d.status == datagramData {
+		return d.dest
+	}
+
+	return d.source
+}
+
+func newMessageWriter(w io.Writer, proto Protocol) messageWriter {
+	if proto == JSONProtocol {
+		return newJSONWriter(w)
+	}
+
+	return newWriter(w)
+}
+
+func newMessageReader(r io.Reader, proto Protocol) messageReader {
+	if proto == JSONProtocol {
+		return newJSONReader(r)
+	}
+
+	return newReader(r)
+}
+
+// Each message ends with a trailer: a counter byte, which catches
+// framing errors, followed by a CRC-32C checksum of the message and
+// the counter, which catches corruption.
+const trailerLen = 1 + 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 type writer struct {
 	*bufio.Writer
 	err     error
 	trailer [1]byte
+
+	// The checksum of the message so far
+	sum hash.Hash32
 }
 
 func newWriter(w io.Writer) *writer {
-	return &writer{bufio.NewWriter(w), nil, [1]byte{1}}
+	return &writer{bufio.NewWriter(w), nil, [1]byte{1}, crc32.New(castagnoli)}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.sum.Write(p)
+	return w.Writer.Write(p)
 }
 
 func step(counter *byte) {
@@ -33,8 +229,12 @@ func step(counter *byte) {
 func (w *writer) endMessage() error {
 	if w.err == nil {
 		_, w.err = w.Write(w.trailer[:])
+		if w.err == nil {
+			_, w.err = w.Writer.Write(end.AppendUint32(nil, w.sum.Sum32()))
+		}
 		if w.err == nil {
 			step(&w.trailer[0])
+			w.sum.Reset()
 			w.err = w.Flush()
 		}
 	}
@@ -65,10 +265,23 @@ type reader struct {
 	*bufio.Reader
 	err     error
 	counter byte
+
+	// The number of bytes consumed so far
+	offset int64
+
+	// The checksum of the message so far
+	sum hash.Hash32
 }
 
 func newReader(r io.Reader) *reader {
-	return &reader{bufio.NewReader(r), nil, 1}
+	return &reader{bufio.NewReader(r), nil, 1, 0, crc32.New(castagnoli)}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.offset += int64(n)
+	r.sum.Write(p[:n])
+	return n, err
 }
 
 func (r *reader) endMessage() error {
@@ -88,7 +301,21 @@ func (r *reader) endMessage() error {
 		return r.err
 	}
 
+	expected := r.sum.Sum32()
+	var sum uint32
+	r.read(&sum)
+	if r.err != nil {
+		return r.err
+	}
+
+	if sum != expected {
+		r.err = fmt.Errorf("expected checksum %08x, got %08x",
+			expected, sum)
+		return r.err
+	}
+
 	step(&r.counter)
+	r.sum.Reset()
 	return nil
 }
 func (r *reader) read(val interface{}) {
@@ -97,52 +324,211 @@ func (r *reader) read(val interface{}) {
 	}
 }
 
+// The maximum number of elements in an array.  The length comes from
+// the peer, so it is checked before anything is allocated for it.
+const maxArrayLen = 1 << 20
+
 func (r *reader) readArray(el interface{}, elemReader func(*reader) interface{}) interface{} {
 	var len uint32
 	r.read(&len)
+	if r.err == nil && len > maxArrayLen {
+		r.err = fmt.Errorf("array length %d exceeds limit of %d",
+			len, maxArrayLen)
+	}
 
-	s := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(el)),
-		int(len), int(len))
+	if r.err != nil {
+		return reflect.Zero(reflect.SliceOf(reflect.TypeOf(el))).Interface()
+	}
 
-	for i := 0; uint32(i) < len; i++ {
-		s.Index(i).Set(reflect.ValueOf(elemReader(r)))
+	// The slice grows as elements are read, so that a bogus
+	// length within the limit still cannot cause an allocation
+	// much larger than the input.
+	s := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(el)),
+		0, min(int(len), 64))
+	for i := 0; uint32(i) < len && r.err == nil; i++ {
+		s = reflect.Append(s, reflect.ValueOf(elemReader(r)))
 	}
 
 	return s.Interface()
 }
 
-func writeNodeID(w *writer, n NodeID) {
-	bytes := ([]byte)(n)
+func writeString(w *writer, s string) {
+	bytes := ([]byte)(s)
 	w.write(uint16(len(bytes)))
 	w.write(bytes)
 }
 
+func writeNodeID(w *writer, n NodeID) {
+	writeString(w, string(n))
+}
+
 func writeConnectivityUpdates(w *writer, updates []propagation.Update) {
 	w.writeArray(updates, func(w *writer, el interface{}) {
 		u := el.(propagation.Update)
 		writeNodeID(w, u.Node)
 		w.write(u.Version)
-		w.writeArray(u.State, func(w *writer, nodeID interface{}) {
-			writeNodeID(w, nodeID.(NodeID))
+		w.writeArray(u.State, func(w *writer, el interface{}) {
+			ls := el.(propagation.LinkState)
+			writeNodeID(w, ls.Node)
+			w.write(int64(ls.RTT))
+			w.write(ls.Parent)
 		})
 	})
 }
 
-func readNodeID(r *reader) NodeID {
+// The size of the binary encoding of a connectivity update
+func updateSize(u propagation.Update) int {
+	size := 2 + len(u.Node) + 8 + 4
+	for _, ls := range u.State.([]propagation.LinkState) {
+		size += 2 + len(ls.Node) + 8 + 1
+	}
+
+	return size
+}
+
+// The size of a binary updates message carrying the given updates,
+// including the message kind and trailer
+func updatesMessageSize(updates []propagation.Update) int {
+	size := 1 + 4 + trailerLen
+	for _, u := range updates {
+		size += updateSize(u)
+	}
+
+	return size
+}
+
+func readString(r *reader) string {
 	var len uint16
 	r.read(&len)
 	bytes := make([]byte, len)
 	r.read(bytes)
-	return NodeID(bytes)
+	return string(bytes)
+}
+
+func readNodeID(r *reader) NodeID {
+	return NodeID(readString(r))
+}
+
+func writeHello(w *writer, h hello) {
+	w.write(h.version)
+	writeNodeID(w, h.node)
+	writeString(w, h.policy)
+}
+
+// Read a hello message.  The version comes first, and the rest of the
+// message is only read if we speak that version.
+func readHello(r *reader) hello {
+	var h hello
+	r.read(&h.version)
+	if r.err != nil || h.version != protocolVersion {
+		return h
+	}
+
+	h.node = readNodeID(r)
+	h.policy = readString(r)
+	return h
 }
 
 func readConnectivityUpdates(r *reader) []propagation.Update {
 	return r.readArray(propagation.Update{}, func(r *reader) interface{} {
 		update := propagation.Update{Node: readNodeID(r)}
 		r.read(&update.Version)
-		update.State = r.readArray(NodeID(""), func(r *reader) interface{} {
-			return readNodeID(r)
+		update.State = r.readArray(propagation.LinkState{}, func(r *reader) interface{} {
+			ls := propagation.LinkState{Node: readNodeID(r)}
+			var rtt int64
+			r.read(&rtt)
+			ls.RTT = time.Duration(rtt)
+			r.read(&ls.Parent)
+			return ls
 		})
 		return update
 	}).([]propagation.Update)
 }
+
+// Read the body of a message following the hello message, without
+// its trailer.
+func readMessageBody(r *reader) message {
+	var msg message
+	r.read(&msg.kind)
+	if r.err != nil {
+		return msg
+	}
+
+	switch msg.kind {
+	case updatesMessage:
+		msg.updates = readConnectivityUpdates(r)
+	case pingMessage, pongMessage:
+		r.read(&msg.stamp)
+	case datagramMessage:
+		msg.datagram = readDatagram(r)
+	default:
+		r.err = fmt.Errorf("unknown message kind %d", byte(msg.kind))
+	}
+
+	return msg
+}
+
+func (w *writer) writeHello(h hello) error {
+	writeHello(w, h)
+	return w.endMessage()
+}
+
+func (w *writer) writeUpdates(updates []propagation.Update) error {
+	w.write(updatesMessage)
+	writeConnectivityUpdates(w, updates)
+	return w.endMessage()
+}
+
+func (w *writer) writePing(stamp int64) error {
+	w.write(pingMessage)
+	w.write(stamp)
+	return w.endMessage()
+}
+
+func (w *writer) writePong(stamp int64) error {
+	w.write(pongMessage)
+	w.write(stamp)
+	return w.endMessage()
+}
+
+func (w *writer) writeDatagram(d datagram) error {
+	w.write(datagramMessage)
+	writeNodeID(w, d.source)
+	writeNodeID(w, d.dest)
+	w.write(d.hops)
+	w.write(d.status)
+	w.write(uint16(len(d.payload)))
+	w.write(d.payload)
+	return w.endMessage()
+}
+
+func readDatagram(r *reader) datagram {
+	d := datagram{source: readNodeID(r), dest: readNodeID(r)}
+	r.read(&d.hops)
+	r.read(&d.status)
+	if r.err == nil && d.status > datagramQueueFull {
+		r.err = fmt.Errorf("unknown datagram status %d", byte(d.status))
+		return d
+	}
+
+	var len uint16
+	r.read(&len)
+	d.payload = make([]byte, len)
+	r.read(d.payload)
+	return d
+}
+
+func (r *reader) readHello() (hello, error) {
+	h := readHello(r)
+	if r.err == nil && h.version != protocolVersion {
+		// The caller reports the version mismatch
+		return h, nil
+	}
+
+	return h, r.endMessage()
+}
+
+func (r *reader) readMessage() (message, error) {
+	msg := readMessageBody(r)
+	return msg, r.endMessage()
+}
@@ -0,0 +1,229 @@
+package comms
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dpw/monotreme/propagation"
+)
+
+func testRoundTrip(t *testing.T, proto Protocol) {
+	updates := []propagation.Update{
+		{Node: "a", Version: 1, State: []propagation.LinkState{
+			{Node: "b", RTT: time.Millisecond},
+			{Node: "c", Parent: true},
+		}},
+		{Node: "b", Version: 7, State: []propagation.LinkState{}},
+	}
+
+	var buf bytes.Buffer
+	w := newMessageWriter(&buf, proto)
+	require.NoError(t, w.writeHello(hello{protocolVersion, "a", "p"}))
+	require.NoError(t, w.writeUpdates(updates))
+	require.NoError(t, w.writeUpdates(nil))
+	require.NoError(t, w.writePing(42))
+	require.NoError(t, w.writePong(43))
+	d := datagram{source: "a", dest: "c", hops: 3,
+		status: datagramHopLimit, payload: []byte("hello")}
+	require.NoError(t, w.writeDatagram(d))
+
+	r := newMessageReader(&buf, proto)
+	h, err := r.readHello()
+	require.NoError(t, err)
+	require.Equal(t, hello{protocolVersion, "a", "p"}, h)
+
+	msg, err := r.readMessage()
+	require.NoError(t, err)
+	require.Equal(t, updatesMessage, msg.kind)
+	require.Equal(t, updates, msg.updates)
+
+	msg, err = r.readMessage()
+	require.NoError(t, err)
+	require.Equal(t, updatesMessage, msg.kind)
+	require.Len(t, msg.updates, 0)
+
+	msg, err = r.readMessage()
+	require.NoError(t, err)
+	require.Equal(t, message{kind: pingMessage, stamp: 42}, msg)
+
+	msg, err = r.readMessage()
+	require.NoError(t, err)
+	require.Equal(t, message{kind: pongMessage, stamp: 43}, msg)
+
+	msg, err = r.readMessage()
+	require.NoError(t, err)
+	require.Equal(t, message{kind: datagramMessage, datagram: d}, msg)
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	testRoundTrip(t, BinaryProtocol)
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	testRoundTrip(t, JSONProtocol)
+}
+
+func TestJSONOneMessagePerLine(t *testing.T) {
+	var buf bytes.Buffer
+	w := newMessageWriter(&buf, JSONProtocol)
+	require.NoError(t, w.writeHello(hello{protocolVersion, "a", "p"}))
+	require.NoError(t, w.writeUpdates([]propagation.Update{
+		{Node: "a", Version: 2, State: []propagation.LinkState{
+			{Node: "b", RTT: 1500},
+		}},
+	}))
+	require.NoError(t, w.writePing(7))
+
+	require.Equal(t, `{"type":"hello","version":1,"node":"a","policy":"p"}
+{"type":"updates","updates":[{"node":"a","version":2,"state":[{"node":"b","rtt":1500}]}]}
+{"type":"ping","stamp":7}
+`, buf.String())
+
+	// Messages out of sequence are rejected
+	r := newMessageReader(bytes.NewBufferString(
+		`{"type":"updates","updates":[]}`+"\n"), JSONProtocol)
+	_, err := r.readHello()
+	require.Error(t, err)
+
+	r = newMessageReader(bytes.NewBufferString(
+		`{"type":"hello","node":"a"}`+"\n"), JSONProtocol)
+	_, err = r.readMessage()
+	require.Error(t, err)
+}
+
+func TestDecode(t *testing.T) {
+	var buf bytes.Buffer
+	w := newWriter(&buf)
+	require.NoError(t, w.writeHello(hello{protocolVersion, "a", "p"}))
+	require.NoError(t, w.writeUpdates([]propagation.Update{
+		{Node: "a", Version: 2, State: []propagation.LinkState{
+			{Node: "b", RTT: 1500 * time.Microsecond},
+			{Node: "c", Parent: true},
+		}},
+	}))
+	require.NoError(t, w.writePing(42))
+
+	var out bytes.Buffer
+	require.NoError(t, Decode(bytes.NewReader(buf.Bytes()), &out))
+	require.Equal(t, `0: hello from node a with tree policy p
+7: trailer 01 ok
+12: 1 updates
+    node a version 2 state [b/1.5ms c/0s/parent]
+56: trailer 02 ok
+61: ping 42
+70: trailer 03 ok
+`, out.String())
+
+	// Corrupt the final trailer
+	stream := append([]byte(nil), buf.Bytes()...)
+	stream[len(stream)-5] = 5
+	out.Reset()
+	err := Decode(bytes.NewReader(stream), &out)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "offset 70")
+	require.Contains(t, err.Error(), "expected trailing byte 3, got 5")
+
+	// Corrupt the ping stamp
+	stream = append([]byte(nil), buf.Bytes()...)
+	stream[62] ^= 1
+	out.Reset()
+	err = Decode(bytes.NewReader(stream), &out)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "offset 70")
+	require.Contains(t, err.Error(), "expected checksum")
+
+	// A hello from a different protocol version
+	stream = append([]byte(nil), buf.Bytes()...)
+	stream[0] = protocolVersion + 1
+	out.Reset()
+	err = Decode(bytes.NewReader(stream), &out)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "offset 0: hello message: protocol version 2")
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	w := newWriter(&buf)
+	require.NoError(t, w.writeHello(hello{protocolVersion, "a", "p"}))
+	require.NoError(t, w.writeUpdates([]propagation.Update{
+		{Node: "a", Version: 2, State: []propagation.LinkState{
+			{Node: "b"},
+		}},
+	}))
+	stream := buf.Bytes()
+
+	// Truncated within the updates message
+	var out bytes.Buffer
+	err := Decode(bytes.NewReader(stream[:len(stream)-trailerLen-5]), &out)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "offset 12: message")
+
+	// An updates message with a huge array length
+	hugeStream := append(append([]byte(nil), stream[:12]...),
+		0x00, 0xff, 0xff, 0xff, 0x7f)
+	err = Decode(bytes.NewReader(hugeStream), &out)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeds limit")
+
+	// A length within the limit, but with no elements following
+	bogusStream := append(append([]byte(nil), stream[:12]...),
+		0x00, 0x00, 0x0f, 0x00, 0x00)
+	err = Decode(bytes.NewReader(bogusStream), &out)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "offset 12: message")
+}
+
+func TestUpdateSize(t *testing.T) {
+	u := propagation.Update{Node: "abc", Version: 1, State: []propagation.LinkState{
+		{Node: "d"},
+		{Node: "ef", RTT: time.Millisecond},
+	}}
+
+	var buf bytes.Buffer
+	w := newWriter(&buf)
+	writeConnectivityUpdates(w, []propagation.Update{u})
+	require.NoError(t, w.Flush())
+	require.Equal(t, buf.Len()-4, updateSize(u))
+
+	buf.Reset()
+	require.NoError(t, w.writeUpdates([]propagation.Update{u, u}))
+	require.Equal(t, buf.Len(), updatesMessageSize([]propagation.Update{u, u}))
+	require.Equal(t, buf.Len(),
+		BinaryProtocol.UpdatesMessageSize([]propagation.Update{u, u}))
+
+	buf.Reset()
+	require.NoError(t, newJSONWriter(&buf).writeUpdates([]propagation.Update{u, u}))
+	require.Equal(t, buf.Len(),
+		JSONProtocol.UpdatesMessageSize([]propagation.Update{u, u}))
+
+	updates := []propagation.Update{u, u, u}
+	limited, cut := limitBatchBytes(BinaryProtocol, updates, 2*updateSize(u))
+	require.True(t, cut)
+	require.Len(t, limited, 2)
+
+	// At least one update is always retained
+	limited, cut = limitBatchBytes(BinaryProtocol, updates, 1)
+	require.True(t, cut)
+	require.Len(t, limited, 1)
+
+	_, cut = limitBatchBytes(BinaryProtocol, updates, 3*updateSize(u))
+	require.False(t, cut)
+
+	_, cut = limitBatchBytes(BinaryProtocol, updates, 0)
+	require.False(t, cut)
+
+	// JSON updates are larger, so fewer fit
+	jsonSize := JSONProtocol.updateSize(u)
+	require.True(t, jsonSize > updateSize(u))
+	limited, cut = limitBatchBytes(JSONProtocol, updates, 3*updateSize(u))
+	require.True(t, cut)
+	require.Len(t, limited, 3*updateSize(u)/jsonSize)
+
+	buf.Reset()
+	require.NoError(t, newJSONWriter(&buf).writeUpdates(updates))
+	require.Equal(t, buf.Len(), JSONProtocol.UpdatesMessageSize(updates))
+	require.True(t, 3*jsonSize >= buf.Len()-len(`{"type":"updates","updates":[]}`+"\n"))
+}
@@ -0,0 +1,121 @@
+package comms
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dpw/monotreme/graph"
+	"github.com/dpw/monotreme/propagation"
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+// A summary of the state of a NodeDaemon, for operators
+type Status struct {
+	Node        NodeID
+	Connections []ConnectionStats
+
+	// Statistics of the cluster topology, as seen by this node
+	Topology graph.Statistics
+
+	// The root and height of the spanning tree over which updates
+	// are propagated
+	TreeRoot   NodeID
+	TreeHeight int
+}
+
+// Get the status of the daemon.  Computing the topology statistics
+// takes time proportional to the product of the numbers of nodes and
+// links in the cluster, but happens outside the event loop.
+func (nd *NodeDaemon) Status() Status {
+	s := Status{Node: nd.us, Connections: nd.ConnectionStats()}
+
+	g, t := nd.topology()
+	s.TreeRoot = t.Root()
+	s.TreeHeight = t.Height()
+	s.Topology = graph.Stats(g)
+	return s
+}
+
+func (s Status) Write(w io.Writer) error {
+	t := s.Topology
+	_, err := fmt.Fprintf(w, `node %s
+  cluster: %d nodes, %d links, connected %t
+  diameter %d, radius %d, center %v, average path length %.2f
+  degree distribution %v
+  tree: root %s, height %d
+`, s.Node, t.Nodes, t.Links, t.Connected, t.Diameter, t.Radius,
+		t.Center, t.AveragePathLength, t.DegreeDistribution,
+		s.TreeRoot, s.TreeHeight)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range s.Connections {
+		_, err := fmt.Fprintf(w, "  peer %s: rtt %v, backlog %d, bridge %t, %d messages, %d updates, %d bytes\n",
+			c.Peer, c.RTT, c.Backlog, c.Bridge, c.Messages,
+			c.Updates, c.Bytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The members of the cluster, as seen by this node.  See
+// Connectivity.Members.
+func (nd *NodeDaemon) Members() []propagation.Member {
+	var res []propagation.Member
+	nd.call(func() { res = nd.connectivity.Members() })
+	return res
+}
+
+// The nodes directly linked to this node.  See
+// Connectivity.Neighbors.
+func (nd *NodeDaemon) Neighbors() []propagation.LinkState {
+	var res []propagation.LinkState
+	nd.call(func() { res = nd.connectivity.Neighbors() })
+	return res
+}
+
+// This node's place in the spanning tree.  See
+// Connectivity.TreeInfo.
+func (nd *NodeDaemon) TreeInfo() propagation.TreeInfo {
+	var res propagation.TreeInfo
+	nd.call(func() { res = nd.connectivity.TreeInfo() })
+	return res
+}
+
+// The graph and the tree over which updates are propagated, as last
+// computed.  Neither is modified afterwards, so they can be used
+// outside the event loop.
+func (nd *NodeDaemon) topology() (graph.Graph, graph.Tree) {
+	var g graph.Graph
+	var t graph.Tree
+	nd.call(func() {
+		g = nd.connectivity.Graph()
+		t = nd.connectivity.PropagationTree()
+	})
+	return g, t
+}
+
+// Write the topology of the cluster as seen by this node, in
+// Graphviz DOT format.  See Connectivity.WriteDOT.
+func (nd *NodeDaemon) WriteDOT(w io.Writer) error {
+	g, t := nd.topology()
+	return graph.WriteTreeDOT(w, g, t)
+}
+
+// Write the topology of the cluster as seen by this node, as JSON.
+// See Connectivity.WriteJSON.
+func (nd *NodeDaemon) WriteJSON(w io.Writer) error {
+	g, t := nd.topology()
+	return graph.WriteTreeJSON(w, g, t)
+}
+
+// Call f with the new TreeInfo whenever this node's place in the
+// spanning tree changes.  f is called from the event loop, so it
+// must not block or call other methods of the daemon.
+func (nd *NodeDaemon) SetTreeInfoFunc(f func(propagation.TreeInfo)) {
+	nd.call(func() { nd.connectivity.SetTreeInfoFunc(f) })
+}
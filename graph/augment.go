@@ -0,0 +1,341 @@
+package graph
+
+import (
+	"cmp"
+	"slices"
+)
+
+// Suggest edges to add to the (symmetric) graph to make it
+// k-edge-connected, so that it remains connected after the failure
+// of any k-1 edges.  Edges are suggested between the nodes with the
+// fewest edges, so that the load of extra links is spread out.  The
+// suggestions are canonical Edges, in the order they were chosen, and
+// are deterministic given the graph.  If max is positive, only the
+// first max suggestions are made, which bounds the work done.
+//
+// The graph is first connected, and then made 2-edge-connected by
+// joining up the leaves of the tree of its 2-edge-connected
+// components, in linear time.  For a connected graph, that uses the
+// fewest edges possible.  For k > 2, a greedy heuristic follows: It
+// repeatedly finds a cut with fewer than k edges by max-flow
+// computations, and adds an edge across it.  That takes O(k*n*m)
+// time, so it is intended for graphs of moderate size.
+func SuggestLinks[N cmp.Ordered](g GraphOf[N], k, max int) []EdgeOf[N] {
+	ig := NewIndexed(g)
+	if ig.Len() < 2 || k < 1 {
+		return nil
+	}
+
+	a := newAugmenter(ig, max)
+	a.connect()
+	if k >= 2 {
+		a.bridgeConnect()
+	}
+	if k >= 3 {
+		a.cutConnect(k)
+	}
+
+	return a.res
+}
+
+// The graph being augmented by SuggestLinks, with the edges
+// suggested so far.  Nodes are identified by their index in ig.
+type augmenter[N cmp.Ordered] struct {
+	ig    *IndexedOf[N]
+	max   int
+	adj   [][]int
+	edges map[EdgeOf[int]]struct{}
+	res   []EdgeOf[N]
+}
+
+func newAugmenter[N cmp.Ordered](ig *IndexedOf[N], max int) *augmenter[N] {
+	a := &augmenter[N]{
+		ig:    ig,
+		max:   max,
+		adj:   make([][]int, ig.Len()),
+		edges: make(map[EdgeOf[int]]struct{}),
+	}
+
+	for i := range a.adj {
+		for _, j := range ig.Edges(i) {
+			if j != i && !a.linked(i, j) {
+				a.link(i, j)
+			}
+		}
+	}
+
+	return a
+}
+
+func (a *augmenter[N]) linked(x, y int) bool {
+	_, present := a.edges[EdgeOf[int]{x, y}.Canonical()]
+	return present
+}
+
+func (a *augmenter[N]) link(x, y int) {
+	a.edges[EdgeOf[int]{x, y}.Canonical()] = struct{}{}
+	a.adj[x] = append(a.adj[x], y)
+	a.adj[y] = append(a.adj[y], x)
+}
+
+func (a *augmenter[N]) suggest(x, y int) {
+	a.link(x, y)
+	a.res = append(a.res, EdgeOf[N]{a.ig.IDs[x], a.ig.IDs[y]}.Canonical())
+}
+
+func (a *augmenter[N]) done() bool {
+	return a.max > 0 && len(a.res) >= a.max
+}
+
+// Order nodes by the number of edges, then by index
+func (a *augmenter[N]) compare(x, y int) int {
+	if c := cmp.Compare(len(a.adj[x]), len(a.adj[y])); c != 0 {
+		return c
+	}
+
+	return cmp.Compare(x, y)
+}
+
+// The node with the fewest edges among nodes, other than except, or
+// -1 if there is none.
+func (a *augmenter[N]) fewest(nodes []int, except int) int {
+	best := -1
+	for _, x := range nodes {
+		if x != except && (best < 0 || a.compare(x, best) < 0) {
+			best = x
+		}
+	}
+
+	return best
+}
+
+// Join the connected components into a chain
+func (a *augmenter[N]) connect() {
+	_, comps := a.components(nil)
+	for i := 1; i < len(comps) && !a.done(); i++ {
+		a.suggest(a.fewest(comps[i-1], -1), a.fewest(comps[i], -1))
+	}
+}
+
+// Make the connected graph 2-edge-connected.  The 2-edge-connected
+// components form a tree whose edges are the bridges.  Pairing each
+// leaf of the tree, in depth-first order, with the leaf half way
+// along from it leaves no bridges, because each bridge separates a
+// contiguous run of the leaves from the rest.
+func (a *augmenter[N]) bridgeConnect() {
+	_, bridges := articulationPointsAndBridges(a.indexed())
+	if len(bridges) == 0 {
+		return
+	}
+
+	ignore := make(map[EdgeOf[int]]struct{}, len(bridges))
+	for _, b := range bridges {
+		ignore[b] = struct{}{}
+	}
+
+	comp, comps := a.components(ignore)
+
+	// The tree of components, and the end of a bridge in each
+	// component, which is the only one for a leaf
+	tree := make([][]int, len(comps))
+	end := make([]int, len(comps))
+	for _, b := range bridges {
+		x, y := comp[b.A], comp[b.B]
+		tree[x] = append(tree[x], y)
+		tree[y] = append(tree[y], x)
+		end[x], end[y] = b.A, b.B
+	}
+
+	// Root the tree at a component that is not a leaf, unless
+	// there are only two
+	root := 0
+	for c := range tree {
+		if len(tree[c]) > 1 {
+			root = c
+			break
+		}
+	}
+
+	var leaves []int
+	visited := make([]bool, len(tree))
+	visited[root] = true
+	stack := []int{root}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if len(tree[c]) == 1 {
+			leaves = append(leaves, c)
+		}
+
+		for i := len(tree[c]) - 1; i >= 0; i-- {
+			if d := tree[c][i]; !visited[d] {
+				visited[d] = true
+				stack = append(stack, d)
+			}
+		}
+	}
+
+	// Within a leaf, avoid the end of the bridge, so that the
+	// new edge is not parallel to it
+	pick := func(c int) int {
+		if len(comps[c]) == 1 {
+			return comps[c][0]
+		}
+
+		return a.fewest(comps[c], end[c])
+	}
+
+	half := len(leaves) / 2
+	for i := 0; i < (len(leaves)+1)/2 && !a.done(); i++ {
+		x, y := pick(leaves[i]), pick(leaves[i+half])
+		if !a.linked(x, y) {
+			a.suggest(x, y)
+		}
+	}
+}
+
+// Make the graph k-edge-connected, by repeatedly finding a cut with
+// fewer than k edges, and adding an edge across it.  Adding edges
+// never reduces the flow between two nodes, so once a node is found
+// to have a flow of k from node 0, it need not be checked again.
+func (a *augmenter[N]) cutConnect(k int) {
+	for t := 1; t < len(a.adj) && !a.done(); {
+		side := a.minCut(0, t, k)
+		if side == nil {
+			t++
+			continue
+		}
+
+		x, y := a.acrossCut(side)
+		if x < 0 {
+			// The cut cannot be strengthened
+			return
+		}
+
+		a.suggest(x, y)
+	}
+}
+
+// The non-adjacent pair across the cut with the fewest edges, or -1s
+// if every pair is adjacent.
+func (a *augmenter[N]) acrossCut(side []bool) (int, int) {
+	var in, out []int
+	for x, s := range side {
+		if s {
+			in = append(in, x)
+		} else {
+			out = append(out, x)
+		}
+	}
+
+	slices.SortFunc(in, a.compare)
+	slices.SortFunc(out, a.compare)
+	for _, x := range in {
+		for _, y := range out {
+			if !a.linked(x, y) {
+				return x, y
+			}
+		}
+	}
+
+	return -1, -1
+}
+
+// Find the maximum flow from s to t, with unit capacities, up to k.
+// If it is less than k, return the side of the minimum cut containing
+// s.  Otherwise return nil.
+func (a *augmenter[N]) minCut(s, t, k int) []bool {
+	// flow[{u, v}] is the flow from u to v, which is -flow[{v, u}]
+	flow := make(map[[2]int]int)
+	prev := make([]int, len(a.adj))
+	for f := 0; ; f++ {
+		// Search for an augmenting path
+		for i := range prev {
+			prev[i] = -1
+		}
+
+		prev[s] = s
+		queue := []int{s}
+		for len(queue) > 0 && prev[t] < 0 {
+			u := queue[0]
+			queue = queue[1:]
+			for _, v := range a.adj[u] {
+				if prev[v] < 0 && flow[[2]int{u, v}] < 1 {
+					prev[v] = u
+					queue = append(queue, v)
+				}
+			}
+		}
+
+		if prev[t] < 0 {
+			// The nodes reachable in the residual graph
+			// form the cut
+			side := make([]bool, len(a.adj))
+			for i, p := range prev {
+				side[i] = p >= 0
+			}
+			return side
+		}
+
+		if f+1 >= k {
+			return nil
+		}
+
+		for v := t; v != s; v = prev[v] {
+			u := prev[v]
+			flow[[2]int{u, v}]++
+			flow[[2]int{v, u}]--
+		}
+	}
+}
+
+// The connected components, ignoring the given edges.  Returns the
+// component of each node, and the nodes of each component in
+// increasing order.  The components are in order of their first
+// nodes.
+func (a *augmenter[N]) components(ignore map[EdgeOf[int]]struct{}) ([]int, [][]int) {
+	comp := make([]int, len(a.adj))
+	for i := range comp {
+		comp[i] = -1
+	}
+
+	var comps [][]int
+	for root := range a.adj {
+		if comp[root] >= 0 {
+			continue
+		}
+
+		c := len(comps)
+		comp[root] = c
+		nodes := []int{root}
+		for i := 0; i < len(nodes); i++ {
+			u := nodes[i]
+			for _, v := range a.adj[u] {
+				_, ignored := ignore[EdgeOf[int]{u, v}.Canonical()]
+				if comp[v] < 0 && !ignored {
+					comp[v] = c
+					nodes = append(nodes, v)
+				}
+			}
+		}
+
+		slices.Sort(nodes)
+		comps = append(comps, nodes)
+	}
+
+	return comp, comps
+}
+
+// The graph as an Indexed graph whose IDs are the node indexes
+func (a *augmenter[N]) indexed() *IndexedOf[int] {
+	ids := make([]int, len(a.adj))
+	offsets := make([]int, 1, len(a.adj)+1)
+	var targets []int
+	for i, js := range a.adj {
+		ids[i] = i
+		targets = append(targets, js...)
+		offsets = append(offsets, len(targets))
+	}
+
+	return newIndexed(ids, offsets, targets, nil)
+}
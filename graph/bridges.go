@@ -0,0 +1,115 @@
+package graph
+
+import (
+	"cmp"
+	"sort"
+)
+
+// Find the articulation points of the (symmetric) graph: the nodes
+// whose removal would increase the number of connected components.
+// The result is sorted.
+func ArticulationPoints[N cmp.Ordered](g GraphOf[N]) []N {
+	points, _ := articulationPointsAndBridges(NewIndexed(g))
+	return points
+}
+
+// Find the bridges of the (symmetric) graph: the edges whose removal
+// would increase the number of connected components.  Each bridge is
+// given once, with A < B, and the result is sorted.
+func Bridges[N cmp.Ordered](g GraphOf[N]) []EdgeOf[N] {
+	_, bridges := articulationPointsAndBridges(NewIndexed(g))
+	return bridges
+}
+
+// Tarjan's algorithm, with an explicit stack so that long chains of
+// nodes do not lead to deep recursion.
+func articulationPointsAndBridges[N cmp.Ordered](ig *IndexedOf[N]) ([]N, []EdgeOf[N]) {
+	n := ig.Len()
+
+	// disc is the DFS discovery time of each node, counting from
+	// 1, so zero means unvisited.  low is the lowest discovery
+	// time reachable from the subtree of the node via a back edge.
+	disc := make([]int, n)
+	low := make([]int, n)
+	parent := make([]int, n)
+	articulation := make([]bool, n)
+	var bridges []EdgeOf[N]
+
+	type frame struct {
+		node int
+
+		// The position in Targets of the next edge to visit
+		edge int
+	}
+
+	time := 0
+	var stack []frame
+	visit := func(node, p int) {
+		time++
+		disc[node] = time
+		low[node] = time
+		parent[node] = p
+		stack = append(stack, frame{node, ig.Offsets[node]})
+	}
+
+	for root := 0; root < n; root++ {
+		if disc[root] != 0 {
+			continue
+		}
+
+		rootChildren := 0
+		visit(root, -1)
+		for len(stack) > 0 {
+			f := &stack[len(stack)-1]
+			u := f.node
+			if f.edge < ig.Offsets[u+1] {
+				v := ig.Targets[f.edge]
+				f.edge++
+
+				if disc[v] == 0 {
+					if u == root {
+						rootChildren++
+					}
+					visit(v, u)
+				} else if v != parent[u] && disc[v] < low[u] {
+					low[u] = disc[v]
+				}
+
+				continue
+			}
+
+			stack = stack[:len(stack)-1]
+			p := parent[u]
+			if p < 0 {
+				continue
+			}
+
+			if low[u] < low[p] {
+				low[p] = low[u]
+			}
+
+			if low[u] > disc[p] {
+				e := EdgeOf[N]{ig.IDs[p], ig.IDs[u]}.Canonical()
+				bridges = append(bridges, e)
+			}
+
+			if p != root && low[u] >= disc[p] {
+				articulation[p] = true
+			}
+		}
+
+		if rootChildren > 1 {
+			articulation[root] = true
+		}
+	}
+
+	var points []N
+	for i, a := range articulation {
+		if a {
+			points = append(points, ig.IDs[i])
+		}
+	}
+
+	sort.Sort(edges[N](bridges))
+	return points, bridges
+}
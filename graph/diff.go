@@ -0,0 +1,155 @@
+package graph
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+// The changes that turn one graph into another
+type DifferenceOf[N cmp.Ordered] struct {
+	AddedNodes   []N
+	RemovedNodes []N
+	AddedEdges   []EdgeOf[N]
+	RemovedEdges []EdgeOf[N]
+}
+
+type Difference = DifferenceOf[NodeID]
+
+func (d DifferenceOf[N]) Empty() bool {
+	return len(d.AddedNodes) == 0 && len(d.RemovedNodes) == 0 &&
+		len(d.AddedEdges) == 0 && len(d.RemovedEdges) == 0
+}
+
+// Find the changes from graph a to graph b.  The edges of a node
+// that is added or removed are included.  The results are sorted.
+func Diff[N cmp.Ordered](a, b GraphOf[N]) DifferenceOf[N] {
+	var d DifferenceOf[N]
+	d.AddedNodes, d.RemovedNodes = diffNodeIDs(a.Nodes, b.Nodes)
+
+	for _, n := range unionNodeIDs(a.Nodes, b.Nodes) {
+		added, removed := diffNodeIDs(a.Edges(n), b.Edges(n))
+		for _, m := range added {
+			d.AddedEdges = append(d.AddedEdges, EdgeOf[N]{n, m})
+		}
+		for _, m := range removed {
+			d.RemovedEdges = append(d.RemovedEdges, EdgeOf[N]{n, m})
+		}
+	}
+
+	return d
+}
+
+// The NodeIDs in b but not a, and those in a but not b, sorted
+func diffNodeIDs[N cmp.Ordered](a, b []N) ([]N, []N) {
+	sa := make(map[N]struct{})
+	for _, n := range a {
+		sa[n] = struct{}{}
+	}
+
+	sb := make(map[N]struct{})
+	for _, n := range b {
+		sb[n] = struct{}{}
+	}
+
+	var added, removed []N
+	for n := range sb {
+		if _, present := sa[n]; !present {
+			added = append(added, n)
+		}
+	}
+	for n := range sa {
+		if _, present := sb[n]; !present {
+			removed = append(removed, n)
+		}
+	}
+
+	return sortNodes(added), sortNodes(removed)
+}
+
+// The changes that turn one tree into another.  Links are Edges from
+// parent to child.
+type TreeDifferenceOf[N cmp.Ordered] struct {
+	AddedNodes   []N
+	RemovedNodes []N
+	AddedLinks   []EdgeOf[N]
+	RemovedLinks []EdgeOf[N]
+
+	// Nodes in both trees whose parent differs, including a node
+	// that is the root of only one of the trees
+	Reparented []N
+
+	// The roots of the trees, if they differ
+	OldRoot, NewRoot N
+}
+
+type TreeDifference = TreeDifferenceOf[NodeID]
+
+func (d TreeDifferenceOf[N]) Empty() bool {
+	return len(d.AddedNodes) == 0 && len(d.RemovedNodes) == 0 &&
+		len(d.AddedLinks) == 0 && len(d.RemovedLinks) == 0 &&
+		d.OldRoot == d.NewRoot
+}
+
+// Find the changes from tree t to tree u.  The results are sorted.
+func (t TreeOf[N]) Diff(u TreeOf[N]) TreeDifferenceOf[N] {
+	var d TreeDifferenceOf[N]
+	if tr, ur := t.Root(), u.Root(); tr != ur {
+		d.OldRoot = tr
+		d.NewRoot = ur
+	}
+
+	parentOf := func(tn *TreeNodeOf[N]) (N, bool) {
+		if tn == nil || tn.parent == nil {
+			var none N
+			return none, false
+		}
+
+		return tn.parent.id, true
+	}
+
+	// Visit the nodes of t and then those only in u, without
+	// sorting them all, as trees usually differ in few nodes
+	visit := func(n N, tn, un *TreeNodeOf[N]) {
+		tp, inT := parentOf(tn)
+		up, inU := parentOf(un)
+		if inT == inU && tp == up {
+			return
+		}
+
+		if inT {
+			d.RemovedLinks = append(d.RemovedLinks, EdgeOf[N]{tp, n})
+		}
+		if inU {
+			d.AddedLinks = append(d.AddedLinks, EdgeOf[N]{up, n})
+		}
+		if tn != nil && un != nil {
+			d.Reparented = append(d.Reparented, n)
+		}
+	}
+
+	for n, tn := range t {
+		un := u[n]
+		if un == nil {
+			d.RemovedNodes = append(d.RemovedNodes, n)
+		}
+
+		visit(n, tn, un)
+	}
+
+	for n, un := range u {
+		if t[n] == nil {
+			d.AddedNodes = append(d.AddedNodes, n)
+			visit(n, nil, un)
+		}
+	}
+
+	slices.Sort(d.AddedNodes)
+	slices.Sort(d.RemovedNodes)
+	slices.Sort(d.Reparented)
+	sort.Sort(edges[N](d.AddedLinks))
+	sort.Sort(edges[N](d.RemovedLinks))
+	return d
+}
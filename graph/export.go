@@ -0,0 +1,201 @@
+package graph
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Write a graph in Graphviz DOT format, e.g. for rendering with
+// "dot -Tsvg".  A pair of nodes with edges in both directions is drawn
+// as a single line, and an edge in only one direction as an arrow.
+// Edge weights are shown as labels.
+func WriteDOT[N cmp.Ordered](w io.Writer, g GraphOf[N]) error {
+	return writeDOT(w, g, nil)
+}
+
+// Write a graph in Graphviz DOT format, as WriteDOT, with the links of
+// the tree drawn in bold and the root of the tree drawn as a double
+// circle.
+func WriteTreeDOT[N cmp.Ordered](w io.Writer, g GraphOf[N], t TreeOf[N]) error {
+	return writeDOT(w, g, t)
+}
+
+// The links of a tree, as canonical edges
+func (t TreeOf[N]) links() map[EdgeOf[N]]struct{} {
+	res := make(map[EdgeOf[N]]struct{})
+	for id, tn := range t {
+		if tn.parent != nil {
+			res[EdgeOf[N]{tn.parent.id, id}.Canonical()] = struct{}{}
+		}
+	}
+	return res
+}
+
+func writeDOT[N cmp.Ordered](w io.Writer, g GraphOf[N], t TreeOf[N]) error {
+	ew := errWriter{w: w}
+	ew.printf("graph {\n")
+
+	root := t.Root()
+	nodes := sortNodes(g.Nodes)
+	for _, n := range nodes {
+		if t != nil && n == root {
+			ew.printf("\t%s [shape=doublecircle];\n", quoteNode(n))
+		} else {
+			ew.printf("\t%s;\n", quoteNode(n))
+		}
+	}
+
+	treeLinks := t.links()
+	for _, e := range exportEdges(g) {
+		if e.reverse {
+			// Only draw a symmetric pair once
+			continue
+		}
+
+		var attrs []string
+		if !e.symmetric {
+			attrs = append(attrs, "dir=forward")
+		}
+
+		if g.Weight != nil {
+			attrs = append(attrs, fmt.Sprintf("label=\"%d\"", e.weight))
+		}
+
+		if _, present := treeLinks[EdgeOf[N]{e.from, e.to}.Canonical()]; present {
+			attrs = append(attrs, "style=bold")
+		}
+
+		ew.printf("\t%s -- %s", quoteNode(e.from), quoteNode(e.to))
+		for i, attr := range attrs {
+			if i == 0 {
+				ew.printf(" [")
+			} else {
+				ew.printf(", ")
+			}
+			ew.printf("%s", attr)
+		}
+		if len(attrs) > 0 {
+			ew.printf("]")
+		}
+		ew.printf(";\n")
+	}
+
+	ew.printf("}\n")
+	return ew.err
+}
+
+type exportEdge[N cmp.Ordered] struct {
+	from, to N
+	weight   int
+
+	// Whether the reverse edge is also present, and whether this
+	// is the second edge of such a pair
+	symmetric bool
+	reverse   bool
+}
+
+// The edges of a graph, sorted and without self-loops
+func exportEdges[N cmp.Ordered](g GraphOf[N]) []exportEdge[N] {
+	present := make(map[EdgeOf[N]]struct{})
+	for _, n := range g.Nodes {
+		for _, m := range g.Edges(n) {
+			present[EdgeOf[N]{n, m}] = struct{}{}
+		}
+	}
+
+	var res []exportEdge[N]
+	for _, n := range sortNodes(g.Nodes) {
+		for _, m := range sortNodes(g.Edges(n)) {
+			if n == m {
+				continue
+			}
+
+			_, symmetric := present[EdgeOf[N]{m, n}]
+			res = append(res, exportEdge[N]{
+				from:      n,
+				to:        m,
+				weight:    g.EdgeWeight(n, m),
+				symmetric: symmetric,
+				reverse:   symmetric && m < n,
+			})
+		}
+	}
+
+	return res
+}
+
+// Node IDs are always quoted, so that they need not be valid DOT
+// identifiers
+func quoteNode[N cmp.Ordered](n N) string {
+	return strconv.Quote(fmt.Sprint(n))
+}
+
+// Accumulates the first error from a series of writes
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err == nil {
+		_, ew.err = fmt.Fprintf(ew.w, format, args...)
+	}
+}
+
+type jsonGraph[N cmp.Ordered] struct {
+	Root  *N            `json:"root,omitempty"`
+	Nodes []N           `json:"nodes"`
+	Edges []jsonEdge[N] `json:"edges"`
+}
+
+type jsonEdge[N cmp.Ordered] struct {
+	From   N    `json:"from"`
+	To     N    `json:"to"`
+	Weight *int `json:"weight,omitempty"`
+	Tree   bool `json:"tree,omitempty"`
+}
+
+// Write a graph as a JSON object, e.g.
+//
+//	{"nodes":["a","b"],"edges":[{"from":"a","to":"b"},{"from":"b","to":"a"}]}
+//
+// Edges have a "weight" if the graph is weighted.  Self-loops are
+// omitted.
+func WriteJSON[N cmp.Ordered](w io.Writer, g GraphOf[N]) error {
+	return writeJSON(w, g, nil)
+}
+
+// Write a graph as a JSON object, as WriteJSON, with the "root" of the
+// tree, and the edges of the tree links marked with "tree":true.
+func WriteTreeJSON[N cmp.Ordered](w io.Writer, g GraphOf[N], t TreeOf[N]) error {
+	return writeJSON(w, g, t)
+}
+
+func writeJSON[N cmp.Ordered](w io.Writer, g GraphOf[N], t TreeOf[N]) error {
+	jg := jsonGraph[N]{
+		Nodes: sortNodes(g.Nodes),
+		Edges: []jsonEdge[N]{},
+	}
+
+	if t != nil {
+		root := t.Root()
+		jg.Root = &root
+	}
+
+	treeLinks := t.links()
+	for _, e := range exportEdges(g) {
+		je := jsonEdge[N]{From: e.from, To: e.to}
+		if g.Weight != nil {
+			weight := e.weight
+			je.Weight = &weight
+		}
+
+		_, je.Tree = treeLinks[EdgeOf[N]{e.from, e.to}.Canonical()]
+		jg.Edges = append(jg.Edges, je)
+	}
+
+	return json.NewEncoder(w).Encode(jg)
+}
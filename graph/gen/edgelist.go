@@ -0,0 +1,102 @@
+package gen
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/dpw/monotreme/graph"
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+// Edge lists are text files with one link per line, given as two node
+// IDs separated by whitespace, e.g.
+//
+//	# a triangle, and an isolated node
+//	0 1
+//	0 2
+//	1 2
+//	3
+//
+// A line with a single node ID declares a node without necessarily
+// linking it to anything.  Blank lines and lines starting with '#' are
+// ignored.
+
+// Write a graph as an edge list.  Nodes without links are written
+// first, followed by the links in sorted order.  Node IDs must be
+// non-empty, must not contain whitespace, and must not start with '#'.
+func WriteEdgeList(w io.Writer, u graph.Undirected) error {
+	linked := make(map[NodeID]struct{})
+	for e := range u.Edges {
+		linked[e.A] = struct{}{}
+		linked[e.B] = struct{}{}
+	}
+
+	for _, n := range u.Nodes {
+		if err := checkEdgeListNode(n); err != nil {
+			return err
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, n := range u.Nodes {
+		if _, present := linked[n]; !present {
+			fmt.Fprintf(bw, "%s\n", n)
+		}
+	}
+
+	for _, e := range u.SortedEdges() {
+		fmt.Fprintf(bw, "%s %s\n", e.A, e.B)
+	}
+
+	return bw.Flush()
+}
+
+func checkEdgeListNode(n NodeID) error {
+	if n == "" || strings.HasPrefix(string(n), "#") ||
+		strings.IndexFunc(string(n), unicode.IsSpace) >= 0 {
+		return fmt.Errorf("node ID %q cannot be written to an edge list", n)
+	}
+
+	return nil
+}
+
+// Read a graph from an edge list.  The nodes are in the order in which
+// they first appear.
+func ReadEdgeList(r io.Reader) (graph.Undirected, error) {
+	u := graph.Undirected{Edges: make(map[graph.Edge]struct{})}
+	seen := make(map[NodeID]struct{})
+	node := func(s string) NodeID {
+		n := NodeID(s)
+		if _, present := seen[n]; !present {
+			seen[n] = struct{}{}
+			u.Nodes = append(u.Nodes, n)
+		}
+		return n
+	}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		switch fields := strings.Fields(text); len(fields) {
+		case 1:
+			node(fields[0])
+		case 2:
+			u.Add(graph.Edge{A: node(fields[0]), B: node(fields[1])})
+		default:
+			return graph.Undirected{}, fmt.Errorf("line %d: expected one or two node IDs, got %d fields", line, len(fields))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return graph.Undirected{}, err
+	}
+
+	return u, nil
+}
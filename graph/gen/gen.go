@@ -0,0 +1,311 @@
+// Package gen generates graph topologies, for tests, benchmarks and
+// simulations.  The nodes of a generated graph of size n are named "0"
+// to "n-1", in that order.  The random generators take a seed, so
+// that the same arguments always produce the same graph.
+//
+// Like make, the generators panic if given a negative size.  The
+// exception is RandomRegular, which returns an error for parameters
+// that admit no graph.
+package gen
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+
+	"github.com/dpw/monotreme/graph"
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+// Panic if a size parameter is negative
+func checkSize(name string, n int) {
+	if n < 0 {
+		panic(fmt.Sprintf("gen: negative %s %d", name, n))
+	}
+}
+
+func newUndirected(n int) graph.Undirected {
+	checkSize("node count", n)
+	u := graph.Undirected{
+		Nodes: make([]NodeID, n),
+		Edges: make(map[graph.Edge]struct{}),
+	}
+
+	for i := range u.Nodes {
+		u.Nodes[i] = NodeID(strconv.Itoa(i))
+	}
+
+	return u
+}
+
+func addEdge(u graph.Undirected, a, b int) {
+	u.Add(graph.Edge{A: u.Nodes[a], B: u.Nodes[b]})
+}
+
+func hasEdge(u graph.Undirected, a, b int) bool {
+	return u.Contains(graph.Edge{A: u.Nodes[a], B: u.Nodes[b]})
+}
+
+// A random tree on n nodes, with extra random edges added to it.  The
+// graph is connected.
+func RandomConnected(seed int64, n, extra int) graph.Undirected {
+	checkSize("extra link count", extra)
+	r := rand.New(rand.NewSource(seed))
+	u := randomTree(r, n)
+	if n < 2 {
+		return u
+	}
+
+	for maxExtra := n*(n-1)/2 - (n - 1); extra > 0 && maxExtra > 0; {
+		a, b := r.Intn(n), r.Intn(n)
+		if !hasEdge(u, a, b) {
+			addEdge(u, a, b)
+			extra--
+			maxExtra--
+		}
+	}
+
+	return u
+}
+
+// A uniformly random labelled tree on n nodes
+func RandomTree(seed int64, n int) graph.Undirected {
+	return randomTree(rand.New(rand.NewSource(seed)), n)
+}
+
+// Decode a random Prüfer sequence into a tree, in linear time
+func randomTree(r *rand.Rand, n int) graph.Undirected {
+	u := newUndirected(n)
+	if n < 2 {
+		return u
+	}
+
+	seq := make([]int, n-2)
+	degree := make([]int, n)
+	for i := range degree {
+		degree[i] = 1
+	}
+	for i := range seq {
+		seq[i] = r.Intn(n)
+		degree[seq[i]]++
+	}
+
+	// leaf is always the lowest-numbered remaining leaf
+	ptr := 0
+	for degree[ptr] != 1 {
+		ptr++
+	}
+	leaf := ptr
+
+	for _, a := range seq {
+		addEdge(u, leaf, a)
+		degree[leaf]--
+		degree[a]--
+		if degree[a] == 1 && a < ptr {
+			leaf = a
+		} else {
+			ptr++
+			for degree[ptr] != 1 {
+				ptr++
+			}
+			leaf = ptr
+		}
+	}
+
+	addEdge(u, leaf, n-1)
+	return u
+}
+
+// A ring of n nodes, each linked to the next
+func Ring(n int) graph.Undirected {
+	u := newUndirected(n)
+	if n > 1 {
+		for i := 0; i < n; i++ {
+			addEdge(u, i, (i+1)%n)
+		}
+	}
+
+	return u
+}
+
+// A rectangular grid of nodes, each linked to the nodes above, below,
+// left and right of it.  Node r*cols+c is in row r and column c.
+func Grid(rows, cols int) graph.Undirected {
+	checkSize("row count", rows)
+	checkSize("column count", cols)
+	u := newUndirected(rows * cols)
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			i := r*cols + c
+			if c+1 < cols {
+				addEdge(u, i, i+1)
+			}
+			if r+1 < rows {
+				addEdge(u, i, i+cols)
+			}
+		}
+	}
+
+	return u
+}
+
+// A complete tree of n nodes in which every node has up to branching
+// children.  Node 0 is the root, and the parent of node i is node
+// (i-1)/branching.
+func Tree(n, branching int) graph.Undirected {
+	u := newUndirected(n)
+	if branching < 1 {
+		branching = 1
+	}
+
+	for i := 1; i < n; i++ {
+		addEdge(u, i, (i-1)/branching)
+	}
+
+	return u
+}
+
+// A Watts-Strogatz small-world graph: A ring of n nodes, each linked
+// to its k nearest neighbours (k/2 on each side), with each link then
+// rewired to a random node with probability p.  The graph may not be
+// connected if p is large.
+func SmallWorld(seed int64, n, k int, p float64) graph.Undirected {
+	r := rand.New(rand.NewSource(seed))
+	u := newUndirected(n)
+	if k >= n {
+		k = n - 1
+	}
+
+	degree := make([]int, n)
+	for j := 1; j <= k/2; j++ {
+		for i := 0; i < n; i++ {
+			addEdge(u, i, (i+j)%n)
+			degree[i]++
+			degree[(i+j)%n]++
+		}
+	}
+
+	for j := 1; j <= k/2; j++ {
+		for i := 0; i < n; i++ {
+			if r.Float64() >= p {
+				continue
+			}
+
+			// Don't rewire if i is already linked to every
+			// other node
+			if degree[i] >= n-1 {
+				continue
+			}
+
+			b := r.Intn(n)
+			for hasEdge(u, i, b) {
+				b = r.Intn(n)
+			}
+
+			old := (i + j) % n
+			u.Remove(graph.Edge{A: u.Nodes[i], B: u.Nodes[old]})
+			degree[old]--
+			addEdge(u, i, b)
+			degree[b]++
+		}
+	}
+
+	return u
+}
+
+// A Barabási-Albert scale-free graph: Starting from a complete graph
+// of m+1 nodes, each further node is linked to m distinct existing
+// nodes, chosen with probability proportional to their degree.  The
+// graph is connected.
+func ScaleFree(seed int64, n, m int) graph.Undirected {
+	r := rand.New(rand.NewSource(seed))
+	u := newUndirected(n)
+	if m < 1 {
+		m = 1
+	}
+
+	// Each node appears in ends once for each of its links, so
+	// that a random element of ends is a degree-weighted choice
+	var ends []int
+	for a := 0; a <= m && a < n; a++ {
+		for b := 0; b < a; b++ {
+			addEdge(u, a, b)
+			ends = append(ends, a, b)
+		}
+	}
+
+	for a := m + 1; a < n; a++ {
+		chosen := make(map[int]struct{})
+		for len(chosen) < m {
+			chosen[ends[r.Intn(len(ends))]] = struct{}{}
+		}
+
+		// Add the links in a deterministic order
+		for b := 0; b < a; b++ {
+			if _, present := chosen[b]; present {
+				addEdge(u, a, b)
+				ends = append(ends, a, b)
+			}
+		}
+	}
+
+	return u
+}
+
+// A random d-regular graph of n nodes, in which every node has exactly
+// d links.  n*d must be even, and d less than n.  The graph is usually
+// connected when d >= 3, but this is not guaranteed.
+func RandomRegular(seed int64, n, d int) (graph.Undirected, error) {
+	if n < 0 || d < 0 || (d >= n && n > 0) || n*d%2 != 0 {
+		return graph.Undirected{}, fmt.Errorf("no %d-regular graph with %d nodes", d, n)
+	}
+
+	r := rand.New(rand.NewSource(seed))
+	for {
+		if u, ok := tryRandomRegular(r, n, d); ok {
+			return u, nil
+		}
+	}
+}
+
+// Pair up the d stubs of each node at random, avoiding self-loops and
+// duplicate links.  This can get stuck, in which case it gives up so
+// that the caller can start again.
+func tryRandomRegular(r *rand.Rand, n, d int) (graph.Undirected, bool) {
+	u := newUndirected(n)
+	var stubs []int
+	for i := 0; i < n; i++ {
+		for j := 0; j < d; j++ {
+			stubs = append(stubs, i)
+		}
+	}
+
+	for len(stubs) > 0 {
+		// Look for a suitable pair among some random
+		// candidates
+		found := false
+		for attempt := 0; attempt < 100 && !found; attempt++ {
+			x := r.Intn(len(stubs))
+			y := r.Intn(len(stubs))
+			a, b := stubs[x], stubs[y]
+			if a == b || hasEdge(u, a, b) {
+				continue
+			}
+
+			addEdge(u, a, b)
+			if x < y {
+				x, y = y, x
+			}
+			stubs[x] = stubs[len(stubs)-1]
+			stubs[y] = stubs[len(stubs)-2]
+			stubs = stubs[:len(stubs)-2]
+			found = true
+		}
+
+		if !found {
+			return u, false
+		}
+	}
+
+	return u, true
+}
@@ -0,0 +1,95 @@
+package gen
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dpw/monotreme/graph"
+)
+
+func degrees(u graph.Undirected) map[int]int {
+	return graph.Stats(u.Graph()).DegreeDistribution
+}
+
+func TestGenerators(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		u := RandomConnected(seed, 50, 10)
+		require.Len(t, u.Nodes, 50)
+		require.Len(t, u.Edges, 59)
+		require.True(t, u.Graph().Connected())
+		require.Equal(t, u.SortedEdges(),
+			RandomConnected(seed, 50, 10).SortedEdges())
+
+		u = RandomTree(seed, 30)
+		require.Len(t, u.Edges, 29)
+		require.True(t, u.Graph().Connected())
+
+		u = SmallWorld(seed, 40, 4, 0.2)
+		require.Len(t, u.Edges, 80)
+		require.Equal(t, u.SortedEdges(),
+			SmallWorld(seed, 40, 4, 0.2).SortedEdges())
+
+		u = ScaleFree(seed, 100, 2)
+		require.Len(t, u.Edges, 3+2*97)
+		require.True(t, u.Graph().Connected())
+
+		u, err := RandomRegular(seed, 20, 3)
+		require.NoError(t, err)
+		require.Equal(t, map[int]int{3: 20}, degrees(u))
+	}
+
+	require.Equal(t, map[int]int{2: 10}, degrees(Ring(10)))
+	require.Equal(t, map[int]int{2: 4, 3: 10, 4: 6}, degrees(Grid(4, 5)))
+	require.Equal(t, 3, graph.Stats(Tree(15, 2).Graph()).Radius)
+	require.Equal(t, map[int]int{1: 8, 2: 1, 3: 6}, degrees(Tree(15, 2)))
+
+	// With p = 0, a small-world graph is a ring lattice
+	require.Equal(t, map[int]int{4: 10}, degrees(SmallWorld(0, 10, 4, 0)))
+
+	_, err := RandomRegular(0, 5, 3)
+	require.Error(t, err)
+}
+
+func TestNegativeSizes(t *testing.T) {
+	require.Panics(t, func() { RandomConnected(0, -1, 0) })
+	require.Panics(t, func() { RandomConnected(0, 10, -1) })
+	require.Panics(t, func() { RandomTree(0, -1) })
+	require.Panics(t, func() { Ring(-1) })
+	require.Panics(t, func() { Grid(-2, 3) })
+	require.Panics(t, func() { Grid(-2, -3) })
+	require.Panics(t, func() { Tree(-1, 2) })
+	require.Panics(t, func() { SmallWorld(0, -1, 4, 0) })
+	require.Panics(t, func() { ScaleFree(0, -1, 2) })
+
+	_, err := RandomRegular(0, -2, 0)
+	require.Error(t, err)
+}
+
+func TestEdgeList(t *testing.T) {
+	u := RandomConnected(1, 20, 5)
+	u.Nodes = append(u.Nodes, "isolated")
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteEdgeList(&buf, u))
+	require.True(t, strings.HasPrefix(buf.String(), "isolated\n"))
+
+	v, err := ReadEdgeList(&buf)
+	require.NoError(t, err)
+	require.Equal(t, u.SortedEdges(), v.SortedEdges())
+	require.Equal(t, graph.SortNodeIDs(u.Nodes), graph.SortNodeIDs(v.Nodes))
+
+	v, err = ReadEdgeList(strings.NewReader("# comment\n\na b\n  c  \nb a\n"))
+	require.NoError(t, err)
+	require.Equal(t, []graph.Edge{{A: "a", B: "b"}}, v.SortedEdges())
+	require.Len(t, v.Nodes, 3)
+
+	_, err = ReadEdgeList(strings.NewReader("a b\na b c\n"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 2")
+
+	u.Nodes = append(u.Nodes, "white space")
+	require.Error(t, WriteEdgeList(&buf, u))
+}
@@ -1,13 +1,19 @@
 package graph
 
 import (
-	"sort"
+	"cmp"
+	"slices"
 
 	. "github.com/dpw/monotreme/rudiments"
 )
 
+// Whether every node in a is also in b
 func NodeIDsEqual(a, b []NodeID) bool {
-	s := make(map[NodeID]struct{})
+	return nodesEqual(a, b)
+}
+
+func nodesEqual[N cmp.Ordered](a, b []N) bool {
+	s := make(map[N]struct{})
 
 	for _, n := range a {
 		s[n] = struct{}{}
@@ -21,37 +27,54 @@ func NodeIDsEqual(a, b []NodeID) bool {
 }
 
 func SortNodeIDs(ids []NodeID) []NodeID {
-	strs := make([]string, len(ids))
-	for i := range ids {
-		strs[i] = string(ids[i])
-	}
-
-	sort.StringSlice(strs).Sort()
-	ids = make([]NodeID, len(ids))
-	for i := range ids {
-		ids[i] = NodeID(strs[i])
-	}
+	return sortNodes(ids)
+}
 
-	return ids
+// A sorted copy of the nodes
+func sortNodes[N cmp.Ordered](ids []N) []N {
+	res := make([]N, len(ids))
+	copy(res, ids)
+	slices.Sort(res)
+	return res
 }
 
 // // A graph is a set of nodes, and a function that produces the
 // outgoing edges from a node.  A Graph is /stable/ if the NodeID
 // arrays returned by the Edge function always appear in the same
 // order.
-type Graph struct {
+//
+// The types and algorithms of this package are generic over the type
+// of the nodes, so they can be used for graphs of things other than
+// monotreme nodes.  The unsuffixed names (Graph, Tree, Edge, etc.) are
+// their instantiations for NodeIDs.
+type GraphOf[N cmp.Ordered] struct {
 	// Get the list of nodes of the graph.  Callers should not
 	// modify the result.
-	Nodes []NodeID
+	Nodes []N
 
 	// Get the edges from the given node.  Returns nil for a node
 	// not in the graph.
-	Edges func(NodeID) []NodeID
+	Edges func(N) []N
+
+	// Get the weight of the edge from one node to another.
+	// Optional: If nil, every edge has weight 1.
+	Weight func(from, to N) int
+}
+
+type Graph = GraphOf[NodeID]
+
+// The weight of the edge from one node to another
+func (g GraphOf[N]) EdgeWeight(from, to N) int {
+	if g.Weight == nil {
+		return 1
+	}
+
+	return g.Weight(from, to)
 }
 
 // Convert the graph to simple map represenation.  Useful for debugging.
-func (g Graph) Map() map[NodeID][]NodeID {
-	res := make(map[NodeID][]NodeID)
+func (g GraphOf[N]) Map() map[N][]N {
+	res := make(map[N][]N)
 
 	for _, n := range g.Nodes {
 		res[n] = g.Edges(n)
@@ -60,8 +83,8 @@ func (g Graph) Map() map[NodeID][]NodeID {
 	return res
 }
 
-func (g Graph) Transpose() Graph {
-	tg := make(map[NodeID][]NodeID)
+func (g GraphOf[N]) Transpose() GraphOf[N] {
+	tg := make(map[N][]N)
 
 	for _, n := range g.Nodes {
 		for _, m := range g.Edges(n) {
@@ -69,28 +92,46 @@ func (g Graph) Transpose() Graph {
 		}
 	}
 
-	return Graph{Nodes: g.Nodes, Edges: func(n NodeID) []NodeID {
+	res := GraphOf[N]{Nodes: g.Nodes, Edges: func(n N) []N {
 		return tg[n]
 	}}
+
+	if g.Weight != nil {
+		res.Weight = func(from, to N) int {
+			return g.Weight(to, from)
+		}
+	}
+
+	return res
 }
 
-func (g Graph) Intersect(h Graph) Graph {
-	return Graph{
+// The intersection of two graphs.  Edge weights are taken from g, or
+// from h if g is unweighted.
+func (g GraphOf[N]) Intersect(h GraphOf[N]) GraphOf[N] {
+	res := GraphOf[N]{
 		Nodes: intersectNodeIDs(g.Nodes, h.Nodes),
-		Edges: func(n NodeID) []NodeID {
+		Edges: func(n N) []N {
 			return intersectNodeIDs(g.Edges(n), h.Edges(n))
 		},
 	}
+
+	if g.Weight != nil {
+		res.Weight = g.Weight
+	} else {
+		res.Weight = h.Weight
+	}
+
+	return res
 }
 
-func intersectNodeIDs(a, b []NodeID) []NodeID {
-	s := make(map[NodeID]struct{})
+func intersectNodeIDs[N cmp.Ordered](a, b []N) []N {
+	s := make(map[N]struct{})
 
 	for _, n := range b {
 		s[n] = struct{}{}
 	}
 
-	var res []NodeID
+	var res []N
 
 	// Use the ordering from a in the result
 	for _, n := range a {
@@ -102,10 +143,12 @@ func intersectNodeIDs(a, b []NodeID) []NodeID {
 	return res
 }
 
-func (g Graph) Union(h Graph) Graph {
-	return Graph{
+// The union of two graphs.  The weight of an edge in g is taken from
+// g, and the weight of other edges from h.
+func (g GraphOf[N]) Union(h GraphOf[N]) GraphOf[N] {
+	res := GraphOf[N]{
 		Nodes: unionNodeIDs(g.Nodes, h.Nodes),
-		Edges: func(n NodeID) []NodeID {
+		Edges: func(n N) []N {
 			ge := g.Edges(n)
 			he := h.Edges(n)
 			if ge == nil && he == nil {
@@ -115,10 +158,24 @@ func (g Graph) Union(h Graph) Graph {
 			}
 		},
 	}
+
+	if g.Weight != nil || h.Weight != nil {
+		res.Weight = func(from, to N) int {
+			for _, n := range g.Edges(from) {
+				if n == to {
+					return g.EdgeWeight(from, to)
+				}
+			}
+
+			return h.EdgeWeight(from, to)
+		}
+	}
+
+	return res
 }
 
-func unionNodeIDs(a, b []NodeID) []NodeID {
-	s := make(map[NodeID]struct{})
+func unionNodeIDs[N cmp.Ordered](a, b []N) []N {
+	s := make(map[N]struct{})
 
 	for _, n := range a {
 		s[n] = struct{}{}
@@ -128,40 +185,44 @@ func unionNodeIDs(a, b []NodeID) []NodeID {
 		s[n] = struct{}{}
 	}
 
-	var res []NodeID
+	var res []N
 
 	for n := range s {
 		res = append(res, n)
 	}
 
-	return SortNodeIDs(res)
+	return sortNodes(res)
 }
 
 // The shortest path result for a particular node
-type ShortestPath struct {
+type ShortestPathOf[N cmp.Ordered] struct {
 	Distance int
-	Initial  NodeID
+	Initial  N
 }
 
+type ShortestPath = ShortestPathOf[NodeID]
+
 // Depth-first search to find shortest paths
 //
 // Stable if the Graph g is stable.
-func FindShortestPaths(g Graph, start NodeID) map[NodeID]ShortestPath {
+func FindShortestPaths[N cmp.Ordered](g GraphOf[N], start N) map[N]ShortestPathOf[N] {
 	type todoItem struct {
-		node    NodeID
-		initial NodeID
+		node    N
+		initial N
 	}
 
-	res := map[NodeID]ShortestPath{start: {0, start}}
+	// Usually most nodes are reachable, so size the result for
+	// all of them rather than growing it repeatedly
+	res := make(map[N]ShortestPathOf[N], len(g.Nodes))
 	var todo_next []todoItem
 	dist := 0
 
-	reached := func(n NodeID, initial NodeID) {
+	reached := func(n N, initial N) {
 		if _, present := res[n]; present {
 			return
 		}
 
-		res[n] = ShortestPath{dist, initial}
+		res[n] = ShortestPathOf[N]{dist, initial}
 		todo_next = append(todo_next, todoItem{n, initial})
 	}
 
@@ -197,16 +258,59 @@ const MaxInt int = int(^uint(0) >> 1)
 
 // Find a pseudo-centrol node: The node with lowest eccentricity with
 // respect to a set of witness nodes.
-func FindPseudoCentralNode(g Graph, witnesses int) NodeID {
-	// The pseudo-eccentricity for each node: the maximum distance
-	// to a witness node
-	eccs := make(map[NodeID]int)
+func FindPseudoCentralNode[N cmp.Ordered](g GraphOf[N], witnesses int) N {
+	return centralNode(PseudoEccentricities(g, witnesses))
+}
+
+// The node with the minimal pseudo-eccentricity and the lowest
+// NodeID.
+func centralNode[N cmp.Ordered](eccs map[N]int) N {
+	minEcc := MaxInt
+	var res N
+
+	for n, e := range eccs {
+		if e < minEcc || (e == minEcc && n < res) {
+			minEcc = e
+			res = n
+		}
+	}
+
+	return res
+}
+
+// Find a pseudo-central node, but with hysteresis: Keep the current
+// node unless the pseudo-eccentricity of the pseudo-central node is
+// lower than that of the current node by more than margin, or the
+// current node is not in the graph.
+func FindStablePseudoCentralNode[N cmp.Ordered](g GraphOf[N], witnesses int, current N, margin int) N {
+	eccs := PseudoEccentricities(g, witnesses)
+	res := centralNode(eccs)
+
+	if currentEcc, present := eccs[current]; present &&
+		currentEcc-eccs[res] <= margin {
+		return current
+	}
+
+	return res
+}
+
+// The pseudo-eccentricity of each node: the maximum distance to a
+// witness node.  The witnesses are chosen from the extremes of the
+// sorted NodeIDs.  Nodes that are not at a positive distance from
+// any witness are omitted.  Distances are weighted if the graph is.
+func PseudoEccentricities[N cmp.Ordered](g GraphOf[N], witnesses int) map[N]int {
+	eccs := make(map[N]int)
+
+	findShortestPaths := FindShortestPaths[N]
+	if g.Weight != nil {
+		findShortestPaths = FindWeightedShortestPaths[N]
+	}
 
 	// Transpose the graph in order to find shortest paths from
 	// candidate pseudo-central nodes to the witnesses:
 	tg := g.Transpose()
-	fillEccsFrom := func(n NodeID) {
-		for m, sp := range FindShortestPaths(tg, n) {
+	fillEccsFrom := func(n N) {
+		for m, sp := range findShortestPaths(tg, n) {
 			if sp.Distance > eccs[m] {
 				eccs[m] = sp.Distance
 			}
@@ -218,7 +322,7 @@ func FindPseudoCentralNode(g Graph, witnesses int) NodeID {
 			fillEccsFrom(n)
 		}
 	} else {
-		nodes := SortNodeIDs(g.Nodes)
+		nodes := sortNodes(g.Nodes)
 
 		a := 0
 		b := len(nodes) - 1
@@ -234,45 +338,37 @@ func FindPseudoCentralNode(g Graph, witnesses int) NodeID {
 		}
 	}
 
-	// The pseudo-central node is the node with the minimal
-	// pseudo-eccentricity and the lowest NodeID.
-	minEcc := MaxInt
-	var res NodeID
-
-	for n, e := range eccs {
-		if e < minEcc || (e == minEcc && n < res) {
-			minEcc = e
-			res = n
-		}
-	}
-
-	return res
+	return eccs
 }
 
-type TreeNode struct {
-	id       NodeID
-	parent   *TreeNode
-	children []*TreeNode
+type TreeNodeOf[N cmp.Ordered] struct {
+	id       N
+	parent   *TreeNodeOf[N]
+	children []*TreeNodeOf[N]
 }
 
-type Tree map[NodeID]*TreeNode
+type TreeNode = TreeNodeOf[NodeID]
+
+type TreeOf[N cmp.Ordered] map[N]*TreeNodeOf[N]
+
+type Tree = TreeOf[NodeID]
 
-func (t Tree) nodes() []NodeID {
-	var res []NodeID
+func (t TreeOf[N]) nodes() []N {
+	var res []N
 	for id, _ := range t {
 		res = append(res, id)
 	}
-	return SortNodeIDs(res)
+	return sortNodes(res)
 }
 
-func (t Tree) Directed() Graph {
-	return Graph{Nodes: t.nodes(), Edges: func(id NodeID) []NodeID {
+func (t TreeOf[N]) Directed() GraphOf[N] {
+	return GraphOf[N]{Nodes: t.nodes(), Edges: func(id N) []N {
 		tn := t[id]
 		if tn == nil {
 			return nil
 		}
 
-		var res []NodeID
+		var res []N
 		for _, child := range tn.children {
 			res = append(res, child.id)
 		}
@@ -281,16 +377,16 @@ func (t Tree) Directed() Graph {
 	}}
 }
 
-func (t Tree) Undirected() Graph {
-	return Graph{Nodes: t.nodes(), Edges: func(id NodeID) []NodeID {
+func (t TreeOf[N]) Undirected() GraphOf[N] {
+	return GraphOf[N]{Nodes: t.nodes(), Edges: func(id N) []N {
 		tn := t[id]
 		if tn == nil {
 			return nil
 		}
 
-		var res []NodeID
+		var res []N
 		if tn.parent != nil {
-			res = []NodeID{tn.parent.id}
+			res = []N{tn.parent.id}
 		}
 
 		for _, child := range tn.children {
@@ -308,12 +404,58 @@ func (t Tree) Undirected() Graph {
 // - constrain the degree of each node according to softChildLimit
 //
 // Stable if the graph is stable.
-func MakeBushySpanningTree(g Graph, root NodeID, softChildLimit int) Tree {
+func MakeBushySpanningTree[N cmp.Ordered](g GraphOf[N], root N, softChildLimit int) TreeOf[N] {
+	return makeBushySpanningTree(g, root, softChildLimit, nil)
+}
+
+// Produce a spanning tree in the manner of MakeBushySpanningTree, but
+// keep the links of a previous tree where they are still present in
+// the graph, so that a small change to the graph produces a small
+// change to the tree.  The previous tree is given by parents, which
+// maps nodes to their parents, and might be a forest or even contain
+// cycles.  The parts of it that remain connected are re-rooted as
+// necessary and attached to the new tree whole, so g should be
+// symmetric.
+//
+// Stable if the graph is stable.
+func UpdateBushySpanningTree[N cmp.Ordered](parents map[N]N, g GraphOf[N], root N, softChildLimit int) TreeOf[N] {
+	inGraph := make(map[N]struct{})
+	for _, n := range g.Nodes {
+		inGraph[n] = struct{}{}
+	}
+
+	// The links of the previous tree that can be retained, in both directions
+	retained := make(map[N][]N)
+	for _, n := range g.Nodes {
+		p, present := parents[n]
+		if !present {
+			continue
+		}
+
+		if _, present := inGraph[p]; !present {
+			continue
+		}
+
+		for _, m := range g.Edges(n) {
+			if m == p {
+				retained[n] = append(retained[n], p)
+				retained[p] = append(retained[p], n)
+				break
+			}
+		}
+	}
+
+	return makeBushySpanningTree(g, root, softChildLimit, retained)
+}
+
+// The bushy spanning tree algorithm.  Whenever a node is added to the
+// tree, the nodes connected to it by retained links are added too.
+func makeBushySpanningTree[N cmp.Ordered](g GraphOf[N], root N, softChildLimit int, retained map[N][]N) TreeOf[N] {
 	type nodeState struct {
-		id NodeID
+		id N
 
 		// If the node has been added to the tree:
-		treeNode *TreeNode
+		treeNode *TreeNodeOf[N]
 		depth    int
 
 		// For a node reached but not added, which nodes this
@@ -322,8 +464,8 @@ func MakeBushySpanningTree(g Graph, root NodeID, softChildLimit int) Tree {
 		reachedIndex int
 	}
 
-	rootNode := &nodeState{id: root, treeNode: &TreeNode{id: root}}
-	nodes := map[NodeID]*nodeState{root: rootNode}
+	rootNode := &nodeState{id: root, treeNode: &TreeNodeOf[N]{id: root}}
+	nodes := map[N]*nodeState{root: rootNode}
 	todo := []*nodeState{rootNode}
 	var todo_next []*nodeState
 
@@ -337,20 +479,47 @@ func MakeBushySpanningTree(g Graph, root NodeID, softChildLimit int) Tree {
 		reached = reached[:l]
 	}
 
+	getNode := func(id N) *nodeState {
+		node := nodes[id]
+		if node == nil {
+			node = &nodeState{id: id}
+			nodes[id] = node
+		}
+
+		return node
+	}
+
+	var attachRetained func(node *nodeState)
+
 	attachTreeNode := func(node *nodeState, parent *nodeState) {
-		tn := &TreeNode{id: node.id, parent: parent.treeNode}
+		tn := &TreeNodeOf[N]{id: node.id, parent: parent.treeNode}
 		tn.parent.children = append(tn.parent.children, tn)
 		node.treeNode = tn
 		node.depth = parent.depth + 1
 		todo_next = append(todo_next, node)
+		attachRetained(node)
 	}
 
-	visit := func(id NodeID, parent *nodeState) {
-		node := nodes[id]
-		if node == nil {
-			node = &nodeState{id: id}
-			nodes[id] = node
+	attachRetained = func(node *nodeState) {
+		for _, id := range retained[node.id] {
+			child := getNode(id)
+			if child.treeNode != nil {
+				continue
+			}
+
+			if child.reachedFrom != nil {
+				child.reachedFrom = nil
+				removeReached(child.reachedIndex)
+			}
+
+			attachTreeNode(child, node)
 		}
+	}
+
+	attachRetained(rootNode)
+
+	visit := func(id N, parent *nodeState) {
+		node := getNode(id)
 
 		if node.treeNode != nil {
 			// already added
@@ -417,7 +586,7 @@ func MakeBushySpanningTree(g Graph, root NodeID, softChildLimit int) Tree {
 		attachTreeNode(node, bestParent)
 	}
 
-	res := make(Tree)
+	res := make(TreeOf[N])
 	for id, node := range nodes {
 		res[id] = node.treeNode
 	}
@@ -425,20 +594,20 @@ func MakeBushySpanningTree(g Graph, root NodeID, softChildLimit int) Tree {
 	return res
 }
 
-type reachable struct {
-	nodes []NodeID
-	edges map[NodeID][]NodeID
+type reachable[N cmp.Ordered] struct {
+	nodes []N
+	edges map[N][]N
 }
 
-func (g *reachable) Nodes() []NodeID {
+func (g *reachable[N]) Nodes() []N {
 	return g.nodes
 }
 
-func (g *reachable) Edges(n NodeID) []NodeID {
+func (g *reachable[N]) Edges(n N) []N {
 	return g.edges[n]
 }
 
-func (g *reachable) visit(n NodeID, edges func(NodeID) []NodeID) {
+func (g *reachable[N]) visit(n N, edges func(N) []N) {
 	if _, present := g.edges[n]; present {
 		return
 	}
@@ -451,16 +620,16 @@ func (g *reachable) visit(n NodeID, edges func(NodeID) []NodeID) {
 	}
 }
 
-func ReachableGraph(start NodeID, edges func(NodeID) []NodeID) Graph {
-	res := reachable{edges: make(map[NodeID][]NodeID)}
+func ReachableGraph[N cmp.Ordered](start N, edges func(N) []N) GraphOf[N] {
+	res := reachable[N]{edges: make(map[N][]N)}
 	res.visit(start, edges)
-	return Graph{Nodes: res.nodes, Edges: func(id NodeID) []NodeID {
+	return GraphOf[N]{Nodes: res.nodes, Edges: func(id N) []N {
 		return res.edges[id]
 	}}
 }
 
-func (g Graph) Connected() bool {
-	r := reachable{edges: make(map[NodeID][]NodeID)}
+func (g GraphOf[N]) Connected() bool {
+	r := reachable[N]{edges: make(map[N][]N)}
 	r.visit(g.Nodes[0], g.Edges)
-	return NodeIDsEqual(g.Nodes, r.nodes)
+	return nodesEqual(g.Nodes, r.nodes)
 }
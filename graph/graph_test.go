@@ -1,8 +1,10 @@
 package graph
 
 import (
+	"bytes"
 	"math/rand"
 	"reflect"
+	"sort"
 	"strconv"
 	"testing"
 	"time"
@@ -255,3 +257,895 @@ func TestMakeBushySpanningTree(t *testing.T) {
 	check(GenerateSparse(r, 100).Graph(), 10, 3)
 	check(GenerateDense(r, 100).Graph(), 10, 3)
 }
+
+// The number of links in one tree but not the other
+func treeLinkChanges(a, b Tree) int {
+	links := func(t Tree) Undirected {
+		u := Undirected{Edges: make(map[Edge]struct{})}
+		for id, tn := range t {
+			if tn.parent != nil {
+				u.Add(Edge{id, tn.parent.id})
+			}
+		}
+		return u
+	}
+
+	la := links(a)
+	lb := links(b)
+	changes := 0
+	for e := range la.Edges {
+		if !lb.Contains(e) {
+			changes++
+		}
+	}
+	for e := range lb.Edges {
+		if !la.Contains(e) {
+			changes++
+		}
+	}
+
+	return changes
+}
+
+func TestUpdateBushySpanningTree(t *testing.T) {
+	r := rng()
+	u := GenerateSparse(r, 50)
+	g := u.Graph()
+	root := FindPseudoCentralNode(g, 10)
+
+	// Without a previous tree, the result is the usual bushy tree
+	scratch := MakeBushySpanningTree(g, root, 4)
+	incremental := UpdateBushySpanningTree(nil, g, root, 4)
+	require.True(t, graphsEqual(scratch.Directed(), incremental.Directed()))
+
+	// Churn the graph, counting the changed tree links
+	scratchChanges := 0
+	incrementalChanges := 0
+
+	for i := 0; i < 200; i++ {
+		e := u.RandomEdge(r)
+		if u.Contains(e) {
+			u.Remove(e)
+			if !u.Graph().Connected() {
+				u.Add(e)
+				continue
+			}
+		} else {
+			u.Add(e)
+		}
+
+		g = u.Graph()
+		root = FindPseudoCentralNode(g, 10)
+
+		nextScratch := MakeBushySpanningTree(g, root, 4)
+		scratchChanges += treeLinkChanges(scratch, nextScratch)
+		scratch = nextScratch
+
+		nextIncremental := UpdateBushySpanningTree(incremental.Parents(), g, root, 4)
+		checkTree(t, nextIncremental, root)
+		require.Equal(t, SortNodeIDs(g.Nodes),
+			SortNodeIDs(nextIncremental.Directed().Nodes))
+		incrementalChanges += treeLinkChanges(incremental,
+			nextIncremental)
+		incremental = nextIncremental
+
+		// Stability
+		require.True(t, graphsEqual(incremental.Directed(),
+			UpdateBushySpanningTree(incremental.Parents(), g, root, 4).Directed()))
+	}
+
+	require.True(t, incrementalChanges < scratchChanges)
+}
+
+func TestForestRoot(t *testing.T) {
+	_, ok := ForestRoot(map[NodeID]NodeID{})
+	require.False(t, ok)
+
+	// The larger tree wins, and the cycle and the nodes leading
+	// to it do not count
+	root, ok := ForestRoot(map[NodeID]NodeID{
+		"b": "a",
+		"d": "c", "e": "c",
+		"x": "y", "y": "z", "z": "x", "w": "x", "v": "w",
+	})
+	require.True(t, ok)
+	require.Equal(t, NodeID("c"), root)
+
+	// Ties are broken by the lowest root
+	root, _ = ForestRoot(map[NodeID]NodeID{"b": "a", "d": "c"})
+	require.Equal(t, NodeID("a"), root)
+}
+
+func TestFindStablePseudoCentralNode(t *testing.T) {
+	g := linearGraph(101)
+
+	// The current node is kept while it is within the margin
+	require.Equal(t, NodeID("48"), FindStablePseudoCentralNode(g, 10,
+		"48", 2))
+	require.Equal(t, NodeID("50"), FindStablePseudoCentralNode(g, 10,
+		"48", 1))
+
+	// A current node that has left the graph is replaced
+	require.Equal(t, NodeID("50"), FindStablePseudoCentralNode(g, 10,
+		"gone", 100))
+}
+
+// Check that a tree spans the graph, and that its links are edges of
+// the graph.
+func checkSpanningTree(t *testing.T, g Graph, tr Tree, root NodeID) {
+	checkTree(t, tr, root)
+	require.Equal(t, root, tr.Root())
+	require.Equal(t, SortNodeIDs(g.Nodes), SortNodeIDs(tr.Directed().Nodes))
+
+	for _, n := range g.Nodes {
+		for _, m := range tr.Directed().Edges(n) {
+			require.Contains(t, g.Edges(n), m)
+		}
+	}
+}
+
+func TestMakeBFSTree(t *testing.T) {
+	r := rng()
+
+	for i := 0; i < 100; i++ {
+		g := GenerateSparse(r, 20).Graph()
+		root := randomNode(g, r)
+		tr := MakeBFSTree(g, root)
+		checkSpanningTree(t, g, tr, root)
+
+		// Depths in the tree are shortest path distances
+		treeSPs := FindShortestPaths(tr.Directed(), root)
+		for n, sp := range FindShortestPaths(g, root) {
+			require.Equal(t, sp.Distance, treeSPs[n].Distance)
+		}
+	}
+}
+
+func TestMakeDegreeBoundedSpanningTree(t *testing.T) {
+	r := rng()
+
+	for i := 0; i < 100; i++ {
+		g := GenerateSparse(r, 20).Graph()
+		root := randomNode(g, r)
+		checkSpanningTree(t, g, MakeDegreeBoundedSpanningTree(g, root, 3),
+			root)
+
+		// In a dense graph, the bound can always be met
+		g = GenerateDense(r, 20).Graph()
+		tr := MakeDegreeBoundedSpanningTree(g, root, 3)
+		checkSpanningTree(t, g, tr, root)
+		for _, n := range g.Nodes {
+			require.True(t, len(tr.Undirected().Edges(n)) <= 3)
+		}
+	}
+}
+
+// Kruskal's algorithm, to check the weight of minimum spanning trees
+func minimumSpanningTreeWeight(u Undirected, weight func(a, b NodeID) int) int {
+	es := u.SortedEdges()
+	sort.Slice(es, func(i, j int) bool {
+		return weight(es[i].A, es[i].B) < weight(es[j].A, es[j].B)
+	})
+
+	component := make(map[NodeID]NodeID)
+	var find func(NodeID) NodeID
+	find = func(n NodeID) NodeID {
+		if c, present := component[n]; present && c != n {
+			c = find(c)
+			component[n] = c
+			return c
+		}
+		return n
+	}
+
+	total := 0
+	for _, e := range es {
+		a := find(e.A)
+		b := find(e.B)
+		if a != b {
+			component[a] = b
+			total += weight(e.A, e.B)
+		}
+	}
+
+	return total
+}
+
+func treeWeight(tr Tree, weight func(a, b NodeID) int) int {
+	total := 0
+	for id, tn := range tr {
+		if tn.parent != nil {
+			total += weight(tn.parent.id, id)
+		}
+	}
+	return total
+}
+
+func TestMakeMinimumSpanningTree(t *testing.T) {
+	r := rng()
+
+	for i := 0; i < 100; i++ {
+		u := GenerateSparse(r, 20)
+		weights := make(map[Edge]int)
+		for e := range u.Edges {
+			weights[e] = r.Intn(10)
+		}
+		weight := func(a, b NodeID) int {
+			return weights[Edge{a, b}.Canonical()]
+		}
+
+		g := u.Graph()
+		g.Weight = weight
+		root := randomNode(g, r)
+		tr := MakeMinimumSpanningTree(g, root)
+		checkSpanningTree(t, g, tr, root)
+		require.Equal(t, minimumSpanningTreeWeight(u, weight),
+			treeWeight(tr, weight))
+
+		// Stability
+		require.True(t, graphsEqual(tr.Directed(),
+			MakeMinimumSpanningTree(g, root).Directed()))
+	}
+}
+
+func randomWeights(r *rand.Rand, u Undirected) func(a, b NodeID) int {
+	weights := make(map[Edge]int)
+	for e := range u.Edges {
+		weights[e] = 1 + r.Intn(10)
+	}
+	return func(a, b NodeID) int {
+		return weights[Edge{a, b}.Canonical()]
+	}
+}
+
+func TestFindWeightedShortestPaths(t *testing.T) {
+	r := rng()
+
+	for i := 0; i < 100; i++ {
+		g := GenerateSparse(r, 20).Graph()
+		start := randomNode(g, r)
+
+		// With unit weights, the distances agree with BFS
+		sps := FindWeightedShortestPaths(g, start)
+		bfs := FindShortestPaths(g, start)
+		require.Len(t, sps, len(bfs))
+		for n, sp := range bfs {
+			require.Equal(t, sp.Distance, sps[n].Distance)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		u := GenerateSparse(r, 20)
+		g := u.Graph()
+		g.Weight = randomWeights(r, u)
+		start := randomNode(g, r)
+		sps := FindWeightedShortestPaths(g, start)
+
+		// Bellman-Ford, to check the distances
+		dist := map[NodeID]int{start: 0}
+		for changed := true; changed; {
+			changed = false
+			for _, n := range g.Nodes {
+				d, present := dist[n]
+				if !present {
+					continue
+				}
+
+				for _, m := range g.Edges(n) {
+					md, present := dist[m]
+					if !present || d+g.Weight(n, m) < md {
+						dist[m] = d + g.Weight(n, m)
+						changed = true
+					}
+				}
+			}
+		}
+
+		require.Len(t, sps, len(dist))
+		for n, d := range dist {
+			sp := sps[n]
+			require.Equal(t, d, sp.Distance)
+			if n != start {
+				// The initial hop lies on a shortest path
+				require.Equal(t, d, g.Weight(start, sp.Initial)+
+					FindWeightedShortestPaths(g, sp.Initial)[n].Distance)
+			}
+		}
+	}
+}
+
+func TestMakeWeightedSpanningTree(t *testing.T) {
+	r := rng()
+
+	for i := 0; i < 100; i++ {
+		u := GenerateSparse(r, 20)
+		g := u.Graph()
+		g.Weight = randomWeights(r, u)
+		root := randomNode(g, r)
+
+		// Without a child limit, it is a shortest path tree
+		tr := MakeWeightedSpanningTree(g, root, len(g.Nodes))
+		checkSpanningTree(t, g, tr, root)
+		sps := FindWeightedShortestPaths(g, root)
+		for id, tn := range tr {
+			if tn.parent != nil {
+				require.Equal(t, sps[id].Distance,
+					sps[tn.parent.id].Distance+
+						g.Weight(tn.parent.id, id))
+			}
+		}
+
+		tr = MakeWeightedSpanningTree(g, root, 2)
+		checkSpanningTree(t, g, tr, root)
+
+		// Stability
+		require.True(t, graphsEqual(tr.Directed(),
+			MakeWeightedSpanningTree(g, root, 2).Directed()))
+	}
+}
+
+func randomDirected(r *rand.Rand, size int) Graph {
+	g := make(map[NodeID][]NodeID)
+	for i := 0; i < size; i++ {
+		n := NodeID(strconv.Itoa(i))
+		g[n] = nil
+		for j := r.Intn(4); j > 0; j-- {
+			g[n] = append(g[n], NodeID(strconv.Itoa(r.Intn(size))))
+		}
+		if g[n] != nil {
+			g[n] = unionNodeIDs(g[n], nil)
+		}
+	}
+
+	return MapGraph(g)
+}
+
+func weightsOf(g Graph) map[Edge]int {
+	res := make(map[Edge]int)
+	for _, n := range g.Nodes {
+		for _, m := range g.Edges(n) {
+			res[Edge{n, m}] = g.EdgeWeight(n, m)
+		}
+	}
+	return res
+}
+
+func TestIndexed(t *testing.T) {
+	r := rng()
+
+	for i := 0; i < 100; i++ {
+		g := randomDirected(r, 20)
+		h := randomDirected(r, 15)
+		weights := make(map[Edge]int)
+		g.Weight = func(a, b NodeID) int {
+			e := Edge{a, b}
+			if _, present := weights[e]; !present {
+				weights[e] = r.Intn(10)
+			}
+			return weights[e]
+		}
+
+		ig := NewIndexed(g)
+		ih := NewIndexed(h)
+		require.Equal(t, g.Map(), ig.Graph().Map())
+		require.Equal(t, weightsOf(g), weightsOf(ig.Graph()))
+
+		for _, c := range []struct{ g, ig Graph }{
+			{g.Transpose(), ig.Transpose().Graph()},
+			{g.Intersect(h), ig.Intersect(ih).Graph()},
+			{h.Intersect(g), ih.Intersect(ig).Graph()},
+			{g.Union(h), ig.Union(ih).Graph()},
+			{h.Union(g), ih.Union(ig).Graph()},
+			{g.Intersect(g.Transpose()).Union(h),
+				ig.Intersect(ig.Transpose()).Union(ih).Graph()},
+		} {
+			require.Equal(t, c.g.Map(), c.ig.Map())
+			require.Equal(t, weightsOf(c.g), weightsOf(c.ig))
+		}
+
+		for i, id := range ig.IDs {
+			j, present := ig.Index(id)
+			require.True(t, present)
+			require.Equal(t, i, j)
+			require.Len(t, ig.EdgeWeights(i), len(ig.Edges(i)))
+		}
+
+		require.Nil(t, ih.EdgeWeights(0))
+		require.Nil(t, ig.Graph().Edges("absent"))
+
+		iw := ih.WithWeights(g.Weight)
+		hw := h
+		hw.Weight = g.Weight
+		require.Equal(t, h.Map(), iw.Graph().Map())
+		require.Equal(t, weightsOf(hw), weightsOf(iw.Graph()))
+		require.True(t, ig.Equal(NewIndexed(g)))
+		require.True(t, iw.Equal(ih.WithWeights(g.Weight)))
+		require.False(t, ih.Equal(iw))
+	}
+}
+
+// A large sparse graph, materialized so that generating it is not
+// part of the benchmarks
+func benchmarkGraph(size int) (Graph, Graph) {
+	r := rand.New(rand.NewSource(1))
+	g := MapGraph(GenerateSparse(r, size).Graph().Map())
+
+	// The local links of a node, as in Connectivity.recompute
+	local := MapGraph(map[NodeID][]NodeID{
+		"0": g.Edges("0"),
+	})
+	local = local.Union(local.Transpose())
+
+	return g, local
+}
+
+func walkEdges(g Graph) int {
+	count := 0
+	for _, n := range g.Nodes {
+		count += len(g.Edges(n))
+	}
+	return count
+}
+
+func BenchmarkSymmetrizeClosures10k(b *testing.B) {
+	g, local := benchmarkGraph(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		walkEdges(g.Intersect(g.Transpose()).Union(local))
+	}
+}
+
+func BenchmarkSymmetrizeIndexed10k(b *testing.B) {
+	g, local := benchmarkGraph(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ig := NewIndexed(g)
+		walkEdges(ig.Intersect(ig.Transpose()).Union(NewIndexed(local)).Graph())
+	}
+}
+
+func BenchmarkBushySpanningTreeClosures10k(b *testing.B) {
+	g, local := benchmarkGraph(10000)
+	g = g.Intersect(g.Transpose()).Union(local)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		MakeBushySpanningTree(g, "0", 4)
+	}
+}
+
+func BenchmarkBushySpanningTreeIndexed10k(b *testing.B) {
+	g, local := benchmarkGraph(10000)
+	ig := NewIndexed(g)
+	g = ig.Intersect(ig.Transpose()).Union(NewIndexed(local)).Graph()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		MakeBushySpanningTree(g, "0", 4)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := MapGraph(map[NodeID][]NodeID{
+		"a": {"b", "c"},
+		"b": {"a"},
+		"c": {"a"},
+	})
+	b := MapGraph(map[NodeID][]NodeID{
+		"a": {"b", "d"},
+		"b": {"a", "d"},
+		"d": {"a", "b"},
+	})
+
+	d := Diff(a, b)
+	require.Equal(t, []NodeID{"d"}, d.AddedNodes)
+	require.Equal(t, []NodeID{"c"}, d.RemovedNodes)
+	require.Equal(t, []Edge{{"a", "d"}, {"b", "d"}, {"d", "a"}, {"d", "b"}},
+		d.AddedEdges)
+	require.Equal(t, []Edge{{"a", "c"}, {"c", "a"}}, d.RemovedEdges)
+	require.False(t, d.Empty())
+
+	require.True(t, Diff(a, a).Empty())
+
+	r := rng()
+	for i := 0; i < 100; i++ {
+		g := randomDirected(r, 20)
+		h := randomDirected(r, 15)
+		d := Diff(g, h)
+
+		// Applying the difference to g yields h
+		nodes := unionNodeIDs(g.Nodes, d.AddedNodes)
+		nodes, _ = diffNodeIDs(d.RemovedNodes, nodes)
+		require.Equal(t, SortNodeIDs(h.Nodes), nodes)
+
+		es := make(map[Edge]struct{})
+		for _, n := range g.Nodes {
+			for _, m := range g.Edges(n) {
+				es[Edge{n, m}] = struct{}{}
+			}
+		}
+		for _, e := range d.AddedEdges {
+			es[e] = struct{}{}
+		}
+		for _, e := range d.RemovedEdges {
+			delete(es, e)
+		}
+
+		count := 0
+		for _, n := range h.Nodes {
+			for _, m := range h.Edges(n) {
+				require.Contains(t, es, Edge{n, m})
+				count++
+			}
+		}
+		require.Len(t, es, count)
+	}
+}
+
+func TestTreeDiff(t *testing.T) {
+	g := MapGraph(map[NodeID][]NodeID{
+		"a": {"b", "c"},
+		"b": {"a", "c"},
+		"c": {"a", "b", "d"},
+		"d": {"c"},
+	})
+
+	ta := MakeBFSTree(g, "a")
+	require.True(t, ta.Diff(ta).Empty())
+
+	d := ta.Diff(MakeBFSTree(g, "b"))
+	require.Empty(t, d.AddedNodes)
+	require.Empty(t, d.RemovedNodes)
+	require.Equal(t, []Edge{{"b", "a"}, {"b", "c"}}, d.AddedLinks)
+	require.Equal(t, []Edge{{"a", "b"}, {"a", "c"}}, d.RemovedLinks)
+	require.Equal(t, []NodeID{"a", "b", "c"}, d.Reparented)
+	require.Equal(t, NodeID("a"), d.OldRoot)
+	require.Equal(t, NodeID("b"), d.NewRoot)
+	require.False(t, d.Empty())
+
+	g = MapGraph(map[NodeID][]NodeID{
+		"a": {"b", "c"},
+		"b": {"a", "e"},
+		"c": {"a"},
+		"e": {"b"},
+	})
+	d = ta.Diff(MakeBFSTree(g, "a"))
+	require.Equal(t, []NodeID{"e"}, d.AddedNodes)
+	require.Equal(t, []NodeID{"d"}, d.RemovedNodes)
+	require.Equal(t, []Edge{{"b", "e"}}, d.AddedLinks)
+	require.Equal(t, []Edge{{"c", "d"}}, d.RemovedLinks)
+	require.Empty(t, d.Reparented)
+	require.Equal(t, NodeID(""), d.NewRoot)
+}
+
+func components(g Graph) int {
+	seen := make(map[NodeID]struct{})
+	count := 0
+	for _, n := range g.Nodes {
+		if _, present := seen[n]; !present {
+			count++
+			for m := range FindShortestPaths(g, n) {
+				seen[m] = struct{}{}
+			}
+		}
+	}
+	return count
+}
+
+func TestArticulationPointsAndBridges(t *testing.T) {
+	// Two triangles joined by a chain
+	u := Undirected{
+		Nodes: []NodeID{"a", "b", "c", "d", "e", "f", "g"},
+		Edges: make(map[Edge]struct{}),
+	}
+	for _, e := range []Edge{{"a", "b"}, {"b", "c"}, {"a", "c"},
+		{"c", "d"}, {"d", "e"}, {"e", "f"}, {"f", "g"}, {"e", "g"}} {
+		u.Add(e)
+	}
+
+	require.Equal(t, []NodeID{"c", "d", "e"}, ArticulationPoints(u.Graph()))
+	require.Equal(t, []Edge{{"c", "d"}, {"d", "e"}}, Bridges(u.Graph()))
+
+	// Compare with brute force
+	r := rng()
+	for i := 0; i < 100; i++ {
+		u := GenerateSparse(r, 15)
+		g := u.Graph()
+		before := components(g)
+
+		var points []NodeID
+		for _, n := range g.Nodes {
+			m := g.Map()
+			delete(m, n)
+			for k, es := range m {
+				m[k], _ = diffNodeIDs([]NodeID{n}, es)
+			}
+			if components(MapGraph(m)) > before {
+				points = append(points, n)
+			}
+		}
+		sort.Slice(points, func(i, j int) bool {
+			return points[i] < points[j]
+		})
+		ap := ArticulationPoints(g)
+		require.Len(t, ap, len(points))
+		for i := range points {
+			require.Equal(t, points[i], ap[i])
+		}
+
+		var bridges []Edge
+		for _, e := range u.SortedEdges() {
+			u.Remove(e)
+			if components(u.Graph()) > before {
+				bridges = append(bridges, e)
+			}
+			u.Add(e)
+		}
+		require.Equal(t, bridges, Bridges(g))
+	}
+}
+
+// Check by brute force that u remains connected after removing any
+// k-1 edges
+func kEdgeConnected(u Undirected, k int) bool {
+	if !u.Graph().Connected() {
+		return false
+	}
+
+	if k <= 1 {
+		return true
+	}
+
+	for _, e := range u.SortedEdges() {
+		u.Remove(e)
+		ok := kEdgeConnected(u, k-1)
+		u.Add(e)
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestSuggestLinks(t *testing.T) {
+	// A path only needs its ends joined
+	require.Equal(t, []Edge{{"a", "d"}}, SuggestLinks(MapGraph(map[NodeID][]NodeID{
+		"a": {"b"},
+		"b": {"a", "c"},
+		"c": {"b", "d"},
+		"d": {"c"},
+	}), 2, 0))
+
+	r := rng()
+	for k := 1; k <= 3; k++ {
+		for i := 0; i < 20; i++ {
+			u := GenerateSparse(r, 8)
+			links := SuggestLinks(u.Graph(), k, 0)
+			for _, e := range links {
+				require.False(t, u.Contains(e))
+				u.Add(e)
+			}
+
+			require.True(t, kEdgeConnected(u, k))
+			require.Empty(t, SuggestLinks(u.Graph(), k, 0))
+		}
+	}
+
+	// Disconnected graphs get connected
+	u := Undirected{
+		Nodes: []NodeID{"a", "b", "c"},
+		Edges: make(map[Edge]struct{}),
+	}
+	u.Add(Edge{"a", "b"})
+	require.Len(t, SuggestLinks(u.Graph(), 1, 0), 1)
+
+	// Large sparse graphs are handled quickly, and max truncates
+	// the suggestions
+	for i := 0; i < 5; i++ {
+		u := GenerateSparse(r, 2000)
+		links := SuggestLinks(u.Graph(), 2, 0)
+		require.Equal(t, links[:10], SuggestLinks(u.Graph(), 2, 10))
+		for _, e := range links {
+			require.False(t, u.Contains(e))
+			u.Add(e)
+		}
+
+		require.Empty(t, Bridges(u.Graph()))
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := Stats(MapGraph(map[NodeID][]NodeID{
+		"a": {"b"},
+		"b": {"a", "c"},
+		"c": {"b", "d"},
+		"d": {"c", "e"},
+		"e": {"d"},
+	}))
+	require.Equal(t, 5, s.Nodes)
+	require.Equal(t, 4, s.Links)
+	require.True(t, s.Connected)
+	require.Equal(t, 4, s.Diameter)
+	require.Equal(t, 2, s.Radius)
+	require.Equal(t, []NodeID{"c"}, s.Center)
+	require.Equal(t, map[int]int{1: 2, 2: 3}, s.DegreeDistribution)
+	require.InDelta(t, 2.0, s.AveragePathLength, 1e-9)
+
+	// Compare with shortest paths
+	r := rng()
+	for i := 0; i < 20; i++ {
+		g := GenerateDense(r, 20).Graph()
+		s := Stats(g)
+
+		diameter := 0
+		radius := MaxInt
+		sum := 0
+		pairs := 0
+		for _, n := range g.Nodes {
+			ecc := 0
+			sps := FindShortestPaths(g, n)
+			for _, sp := range sps {
+				if sp.Distance > ecc {
+					ecc = sp.Distance
+				}
+				sum += sp.Distance
+			}
+			pairs += len(sps) - 1
+
+			if ecc > diameter {
+				diameter = ecc
+			}
+			if ecc < radius {
+				radius = ecc
+			}
+		}
+
+		require.Equal(t, g.Connected(), s.Connected)
+		require.Equal(t, diameter, s.Diameter)
+		require.Equal(t, radius, s.Radius)
+		require.InDelta(t, float64(sum)/float64(pairs),
+			s.AveragePathLength, 1e-9)
+	}
+
+	// A disconnected graph
+	s = Stats(MapGraph(map[NodeID][]NodeID{
+		"a": {"b"},
+		"b": {"a"},
+		"c": {},
+	}))
+	require.False(t, s.Connected)
+	require.Equal(t, 1, s.Diameter)
+	require.Equal(t, 0, s.Radius)
+	require.Equal(t, []NodeID{"c"}, s.Center)
+}
+
+func TestTreeHeight(t *testing.T) {
+	g := MapGraph(map[NodeID][]NodeID{
+		"a": {"b"},
+		"b": {"a", "c"},
+		"c": {"b"},
+	})
+	require.Equal(t, 2, MakeBFSTree(g, "a").Height())
+	require.Equal(t, 1, MakeBFSTree(g, "b").Height())
+	require.Equal(t, 0, Tree{}.Height())
+}
+
+func TestTreeRelations(t *testing.T) {
+	g := MapGraph(map[NodeID][]NodeID{
+		"a": {"b", "c"},
+		"b": {"a", "d"},
+		"c": {"a"},
+		"d": {"b"},
+	})
+	tree := MakeBFSTree(g, "a")
+
+	_, ok := tree.Parent("a")
+	require.False(t, ok)
+	p, ok := tree.Parent("d")
+	require.True(t, ok)
+	require.Equal(t, NodeID("b"), p)
+	_, ok = tree.Parent("x")
+	require.False(t, ok)
+
+	require.Equal(t, []NodeID{"b", "c"}, tree.Children("a"))
+	require.Empty(t, tree.Children("c"))
+
+	require.Equal(t, []NodeID{"b", "c"}, tree.Links("a"))
+	require.Equal(t, []NodeID{"a", "d"}, tree.Links("b"))
+	require.Nil(t, tree.Links("x"))
+
+	require.Equal(t, 0, tree.Depth("a"))
+	require.Equal(t, 2, tree.Depth("d"))
+	require.Equal(t, -1, tree.Depth("x"))
+}
+
+func BenchmarkStats10k(b *testing.B) {
+	g, _ := benchmarkGraph(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Stats(g)
+	}
+}
+
+func TestExport(t *testing.T) {
+	g := MapGraph(map[NodeID][]NodeID{
+		"a": {"b", "c", "a"},
+		"b": {"a", "c"},
+		"c": {"a", "b", "d"},
+		"d": {},
+	})
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteDOT(&buf, g))
+	require.Equal(t, `graph {
+	"a";
+	"b";
+	"c";
+	"d";
+	"a" -- "b";
+	"a" -- "c";
+	"b" -- "c";
+	"c" -- "d" [dir=forward];
+}
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, WriteTreeDOT(&buf, g, MakeBFSTree(g, "a")))
+	require.Equal(t, `graph {
+	"a" [shape=doublecircle];
+	"b";
+	"c";
+	"d";
+	"a" -- "b" [style=bold];
+	"a" -- "c" [style=bold];
+	"b" -- "c";
+	"c" -- "d" [dir=forward, style=bold];
+}
+`, buf.String())
+
+	g = MapGraph(map[NodeID][]NodeID{"a": {"b"}, "b": {"a"}})
+	g.Weight = func(a, b NodeID) int { return 7 }
+
+	buf.Reset()
+	require.NoError(t, WriteJSON(&buf, g))
+	require.Equal(t, `{"nodes":["a","b"],"edges":[{"from":"a","to":"b","weight":7},{"from":"b","to":"a","weight":7}]}
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, WriteTreeJSON(&buf, g, MakeBFSTree(g, "b")))
+	require.Equal(t, `{"root":"b","nodes":["a","b"],"edges":[{"from":"a","to":"b","weight":7,"tree":true},{"from":"b","to":"a","weight":7,"tree":true}]}
+`, buf.String())
+}
+
+func TestIntGraph(t *testing.T) {
+	// A path 0-1-2-3-4, with a spur 2-5
+	g := MapGraph(map[int][]int{
+		0: {1},
+		1: {0, 2},
+		2: {1, 3, 5},
+		3: {2, 4},
+		4: {3},
+		5: {2},
+	})
+
+	paths := FindShortestPaths(g, 0)
+	require.Equal(t, ShortestPathOf[int]{4, 1}, paths[4])
+	require.Equal(t, 2, FindPseudoCentralNode(g, len(g.Nodes)))
+
+	tree := MakeBushySpanningTree(g, 2, 2)
+	require.Equal(t, 2, tree.Root())
+	require.Equal(t, 2, tree.Height())
+	require.True(t, tree.Undirected().Connected())
+
+	stats := Stats(g)
+	require.Equal(t, 5, stats.Links)
+	require.Equal(t, 4, stats.Diameter)
+	require.Equal(t, []int{2}, stats.Center)
+	require.Equal(t, []EdgeOf[int]{{0, 1}, {1, 2}, {2, 3}, {2, 5}, {3, 4}},
+		Bridges(g))
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteTreeJSON(&buf, MapGraph(map[int][]int{0: {1}, 1: {0}}),
+		MakeBFSTree(g, 0)))
+	require.Equal(t, `{"root":0,"nodes":[0,1],"edges":[{"from":0,"to":1,"tree":true},{"from":1,"to":0,"tree":true}]}
+`, buf.String())
+}
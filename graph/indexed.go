@@ -0,0 +1,386 @@
+package graph
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+// An Indexed graph is a materialized graph in compressed sparse row
+// form.  Nodes are identified by their index in IDs, which is
+// sorted, and the edges from node i go to the nodes with indexes
+// Targets[Offsets[i]:Offsets[i+1]].
+//
+// Unlike a Graph built with Union, Intersect and Transpose, looking
+// up the edges of a node does not allocate, and combining Indexed
+// graphs produces another Indexed graph rather than a stack of
+// closures.  An Indexed graph should not be modified once built.
+type IndexedOf[N cmp.Ordered] struct {
+	IDs     []N
+	Offsets []int
+	Targets []int
+
+	// The weights of the edges, parallel to Targets, or nil if
+	// the graph is unweighted
+	Weights []int
+
+	index     map[N]int
+	targetIDs []N
+}
+
+type Indexed = IndexedOf[NodeID]
+
+func newIndexed[N cmp.Ordered](ids []N, offsets, targets, weights []int) *IndexedOf[N] {
+	ig := &IndexedOf[N]{
+		IDs:       ids,
+		Offsets:   offsets,
+		Targets:   targets,
+		Weights:   weights,
+		index:     make(map[N]int, len(ids)),
+		targetIDs: make([]N, len(targets)),
+	}
+
+	for i, id := range ids {
+		ig.index[id] = i
+	}
+
+	for e, t := range targets {
+		ig.targetIDs[e] = ids[t]
+	}
+
+	return ig
+}
+
+// Materialize a Graph.  Edges to nodes that are not in g.Nodes are
+// dropped.  The order of the edges of each node is preserved, so the
+// Indexed graph is stable if g is.
+func NewIndexed[N cmp.Ordered](g GraphOf[N]) *IndexedOf[N] {
+	ids := sortNodes(g.Nodes)
+	index := make(map[N]int, len(ids))
+	for i, id := range ids {
+		index[id] = i
+	}
+
+	offsets := make([]int, len(ids)+1)
+	var targets, weights []int
+	for i, id := range ids {
+		for _, n := range g.Edges(id) {
+			if t, present := index[n]; present {
+				targets = append(targets, t)
+				if g.Weight != nil {
+					weights = append(weights, g.Weight(id, n))
+				}
+			}
+		}
+
+		offsets[i+1] = len(targets)
+	}
+
+	if g.Weight != nil && weights == nil {
+		weights = []int{}
+	}
+
+	return newIndexed(ids, offsets, targets, weights)
+}
+
+// The number of nodes
+func (ig *IndexedOf[N]) Len() int {
+	return len(ig.IDs)
+}
+
+// The index of the given node
+func (ig *IndexedOf[N]) Index(id N) (int, bool) {
+	i, present := ig.index[id]
+	return i, present
+}
+
+// The indexes of the nodes that the edges from node i go to.
+// Callers should not modify the result.
+func (ig *IndexedOf[N]) Edges(i int) []int {
+	return ig.Targets[ig.Offsets[i]:ig.Offsets[i+1]:ig.Offsets[i+1]]
+}
+
+// The weights of the edges from node i, parallel to Edges(i), or nil
+// if the graph is unweighted.
+func (ig *IndexedOf[N]) EdgeWeights(i int) []int {
+	if ig.Weights == nil {
+		return nil
+	}
+
+	return ig.Weights[ig.Offsets[i]:ig.Offsets[i+1]:ig.Offsets[i+1]]
+}
+
+// A Graph view of the Indexed graph.  Its Edges function does not
+// allocate, and returns nil for absent and isolated nodes.
+func (ig *IndexedOf[N]) Graph() GraphOf[N] {
+	g := GraphOf[N]{
+		Nodes: ig.IDs,
+		Edges: func(id N) []N {
+			i, present := ig.index[id]
+			if !present {
+				return nil
+			}
+
+			// Like the closure-based graphs, an isolated
+			// node has nil edges.  prune relies on this.
+			a := ig.Offsets[i]
+			b := ig.Offsets[i+1]
+			if a == b {
+				return nil
+			}
+
+			return ig.targetIDs[a:b:b]
+		},
+	}
+
+	if ig.Weights != nil {
+		g.Weight = func(from, to N) int {
+			i, present := ig.index[from]
+			if !present {
+				return 1
+			}
+
+			for e := ig.Offsets[i]; e < ig.Offsets[i+1]; e++ {
+				if ig.targetIDs[e] == to {
+					return ig.Weights[e]
+				}
+			}
+
+			return 1
+		}
+	}
+
+	return g
+}
+
+// The same graph with the edge weights given by weight.  The result
+// shares everything but the weights with ig, and does not retain
+// weight.
+func (ig *IndexedOf[N]) WithWeights(weight func(from, to N) int) *IndexedOf[N] {
+	res := *ig
+	res.Weights = make([]int, len(ig.Targets))
+	for i, id := range ig.IDs {
+		for e := ig.Offsets[i]; e < ig.Offsets[i+1]; e++ {
+			res.Weights[e] = weight(id, ig.targetIDs[e])
+		}
+	}
+
+	return &res
+}
+
+// Whether two Indexed graphs have the same nodes, edges and weights
+func (ig *IndexedOf[N]) Equal(h *IndexedOf[N]) bool {
+	return slices.Equal(ig.IDs, h.IDs) &&
+		slices.Equal(ig.Offsets, h.Offsets) &&
+		slices.Equal(ig.Targets, h.Targets) &&
+		(ig.Weights == nil) == (h.Weights == nil) &&
+		slices.Equal(ig.Weights, h.Weights)
+}
+
+func (ig *IndexedOf[N]) Transpose() *IndexedOf[N] {
+	offsets := make([]int, len(ig.IDs)+1)
+	for _, t := range ig.Targets {
+		offsets[t+1]++
+	}
+
+	for i := range ig.IDs {
+		offsets[i+1] += offsets[i]
+	}
+
+	fill := make([]int, len(ig.IDs))
+	copy(fill, offsets)
+	targets := make([]int, len(ig.Targets))
+	var weights []int
+	if ig.Weights != nil {
+		weights = make([]int, len(ig.Weights))
+	}
+
+	for i := range ig.IDs {
+		for e := ig.Offsets[i]; e < ig.Offsets[i+1]; e++ {
+			t := ig.Targets[e]
+			targets[fill[t]] = i
+			if weights != nil {
+				weights[fill[t]] = ig.Weights[e]
+			}
+			fill[t]++
+		}
+	}
+
+	return newIndexed(ig.IDs, offsets, targets, weights)
+}
+
+// Merge two sorted lists of NodeIDs, taking their union or
+// intersection.  Also returns the mapping from the indexes of a and b
+// to the indexes of the result, with -1 for those absent from the
+// result.
+func mergeNodeIDs[N cmp.Ordered](a, b []N, union bool) ([]N, []int, []int) {
+	var res []N
+	aToRes := make([]int, len(a))
+	bToRes := make([]int, len(b))
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i] < b[j]):
+			aToRes[i] = -1
+			if union {
+				aToRes[i] = len(res)
+				res = append(res, a[i])
+			}
+			i++
+		case i == len(a) || b[j] < a[i]:
+			bToRes[j] = -1
+			if union {
+				bToRes[j] = len(res)
+				res = append(res, b[j])
+			}
+			j++
+		default:
+			aToRes[i] = len(res)
+			bToRes[j] = len(res)
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+
+	return res, aToRes, bToRes
+}
+
+// The intersection of two Indexed graphs.  The order of edges is
+// taken from ig.  Edge weights are taken from ig, or from h if ig is
+// unweighted.
+func (ig *IndexedOf[N]) Intersect(h *IndexedOf[N]) *IndexedOf[N] {
+	ids, igToRes, hToRes := mergeNodeIDs(ig.IDs, h.IDs, false)
+	resToIg := make([]int, len(ids))
+	resToH := make([]int, len(ids))
+	for i, r := range igToRes {
+		if r >= 0 {
+			resToIg[r] = i
+		}
+	}
+	for i, r := range hToRes {
+		if r >= 0 {
+			resToH[r] = i
+		}
+	}
+
+	// For the current node, hEdge records the position in h of
+	// the edge to each result node, if stamp matches
+	stamp := make([]int, len(ids))
+	hEdge := make([]int, len(ids))
+
+	offsets := make([]int, len(ids)+1)
+	var targets, weights []int
+	weighted := ig.Weights != nil || h.Weights != nil
+	if weighted {
+		weights = []int{}
+	}
+
+	for r := range ids {
+		hi := resToH[r]
+		for e := h.Offsets[hi]; e < h.Offsets[hi+1]; e++ {
+			if t := hToRes[h.Targets[e]]; t >= 0 {
+				stamp[t] = r + 1
+				hEdge[t] = e
+			}
+		}
+
+		ii := resToIg[r]
+		for e := ig.Offsets[ii]; e < ig.Offsets[ii+1]; e++ {
+			t := igToRes[ig.Targets[e]]
+			if t < 0 || stamp[t] != r+1 {
+				continue
+			}
+
+			targets = append(targets, t)
+			if ig.Weights != nil {
+				weights = append(weights, ig.Weights[e])
+			} else if weighted {
+				weights = append(weights, h.Weights[hEdge[t]])
+			}
+		}
+
+		offsets[r+1] = len(targets)
+	}
+
+	return newIndexed(ids, offsets, targets, weights)
+}
+
+// The union of two Indexed graphs.  The edges of each node are sorted
+// by NodeID.  The weight of an edge in ig is taken from ig, and the
+// weight of other edges from h.
+func (ig *IndexedOf[N]) Union(h *IndexedOf[N]) *IndexedOf[N] {
+	ids, igToRes, hToRes := mergeNodeIDs(ig.IDs, h.IDs, true)
+	resToIg := make([]int, len(ids))
+	resToH := make([]int, len(ids))
+	for r := range ids {
+		resToIg[r] = -1
+		resToH[r] = -1
+	}
+	for i, r := range igToRes {
+		resToIg[r] = i
+	}
+	for i, r := range hToRes {
+		resToH[r] = i
+	}
+
+	weighted := ig.Weights != nil || h.Weights != nil
+	weightOf := func(g *IndexedOf[N], e int) int {
+		if g.Weights == nil {
+			return 1
+		}
+		return g.Weights[e]
+	}
+
+	// For the current node, stamp records which result nodes
+	// already have an edge
+	stamp := make([]int, len(ids))
+	type edge struct{ target, weight int }
+	var es []edge
+
+	offsets := make([]int, len(ids)+1)
+	var targets, weights []int
+	if weighted {
+		weights = []int{}
+	}
+
+	add := func(r int, g *IndexedOf[N], toRes []int, i int) {
+		if i < 0 {
+			return
+		}
+
+		for e := g.Offsets[i]; e < g.Offsets[i+1]; e++ {
+			t := toRes[g.Targets[e]]
+			if stamp[t] != r+1 {
+				stamp[t] = r + 1
+				es = append(es, edge{t, weightOf(g, e)})
+			}
+		}
+	}
+
+	less := func(i, j int) bool { return es[i].target < es[j].target }
+
+	for r := range ids {
+		es = es[:0]
+		add(r, ig, igToRes, resToIg[r])
+		add(r, h, hToRes, resToH[r])
+
+		if !sort.SliceIsSorted(es, less) {
+			sort.Slice(es, less)
+		}
+
+		for _, e := range es {
+			targets = append(targets, e.target)
+			if weighted {
+				weights = append(weights, e.weight)
+			}
+		}
+
+		offsets[r+1] = len(targets)
+	}
+
+	return newIndexed(ids, offsets, targets, weights)
+}
@@ -0,0 +1,335 @@
+package graph
+
+import (
+	"cmp"
+	"container/heap"
+)
+
+// The root of the tree, or the zero value if the tree is empty
+func (t TreeOf[N]) Root() N {
+	var root N
+	for id, tn := range t {
+		if tn.parent == nil {
+			return id
+		}
+	}
+
+	return root
+}
+
+// The length of the longest path from the root of the tree to a
+// leaf
+func (t TreeOf[N]) Height() int {
+	var height func(tn *TreeNodeOf[N]) int
+	height = func(tn *TreeNodeOf[N]) int {
+		h := 0
+		for _, child := range tn.children {
+			if ch := height(child) + 1; ch > h {
+				h = ch
+			}
+		}
+		return h
+	}
+
+	if root := t[t.Root()]; root != nil {
+		return height(root)
+	}
+
+	return 0
+}
+
+// The parent of node n in the tree, and whether it has one.  The
+// root and nodes not in the tree have no parent.
+func (t TreeOf[N]) Parent(n N) (N, bool) {
+	if tn := t[n]; tn != nil && tn.parent != nil {
+		return tn.parent.id, true
+	}
+
+	var none N
+	return none, false
+}
+
+// The children of node n in the tree, sorted, or nil if it has none
+func (t TreeOf[N]) Children(n N) []N {
+	tn := t[n]
+	if tn == nil || len(tn.children) == 0 {
+		return nil
+	}
+
+	children := make([]N, len(tn.children))
+	for i, child := range tn.children {
+		children[i] = child.id
+	}
+
+	return sortNodes(children)
+}
+
+// The nodes linked to node n in the tree, i.e. its parent and
+// children, sorted, or nil if there are none
+func (t TreeOf[N]) Links(n N) []N {
+	links := t.Children(n)
+	if parent, ok := t.Parent(n); ok {
+		links = sortNodes(append(links, parent))
+	}
+
+	return links
+}
+
+// The number of links between node n and the root, or -1 if n is not
+// in the tree
+func (t TreeOf[N]) Depth(n N) int {
+	tn := t[n]
+	if tn == nil {
+		return -1
+	}
+
+	depth := 0
+	for ; tn.parent != nil; tn = tn.parent {
+		depth++
+	}
+
+	return depth
+}
+
+// The parent of each node in the tree that has one
+func (t TreeOf[N]) Parents() map[N]N {
+	res := make(map[N]N)
+	for id, tn := range t {
+		if tn.parent != nil {
+			res[id] = tn.parent.id
+		}
+	}
+
+	return res
+}
+
+// The root of the largest tree in the forest described by parents,
+// which maps nodes to their parents, or false if there is no such
+// tree.  A lone node is not a tree, and nodes on a cycle belong to
+// no tree.  Ties are broken by the lowest root.
+func ForestRoot[N cmp.Ordered](parents map[N]N) (N, bool) {
+	// The root reached from each node visited so far, or false if
+	// it leads to a cycle
+	type result struct {
+		root N
+		ok   bool
+	}
+	results := make(map[N]result)
+	sizes := make(map[N]int)
+
+	var path []N
+	onPath := make(map[N]struct{})
+	for n := range parents {
+		// Follow the parents until reaching a root, a node
+		// already visited, or a node on the path, which means
+		// a cycle
+		path = path[:0]
+		clear(onPath)
+		m := n
+		var res result
+		for {
+			if r, visited := results[m]; visited {
+				res = r
+				break
+			}
+
+			if _, cycle := onPath[m]; cycle {
+				break
+			}
+
+			p, present := parents[m]
+			if !present {
+				res = result{m, true}
+				break
+			}
+
+			path = append(path, m)
+			onPath[m] = struct{}{}
+			m = p
+		}
+
+		for _, m := range path {
+			results[m] = res
+			if res.ok {
+				sizes[res.root]++
+			}
+		}
+	}
+
+	var root N
+	size := 0
+	for n, s := range sizes {
+		if s > size || (s == size && n < root) {
+			root = n
+			size = s
+		}
+	}
+
+	return root, size > 0
+}
+
+func (tn *TreeNodeOf[N]) addChild(id N) *TreeNodeOf[N] {
+	child := &TreeNodeOf[N]{id: id, parent: tn}
+	tn.children = append(tn.children, child)
+	return child
+}
+
+// Produce a breadth-first spanning tree from the given root, in which
+// each node is as close to the root as possible.
+//
+// Stable if the graph is stable.
+func MakeBFSTree[N cmp.Ordered](g GraphOf[N], root N) TreeOf[N] {
+	res := TreeOf[N]{root: &TreeNodeOf[N]{id: root}}
+	todo := []N{root}
+
+	for len(todo) > 0 {
+		parent := res[todo[0]]
+		todo = todo[1:]
+
+		for _, n := range g.Edges(parent.id) {
+			if res[n] == nil {
+				res[n] = parent.addChild(n)
+				todo = append(todo, n)
+			}
+		}
+	}
+
+	return res
+}
+
+// Produce a spanning tree in which the degree of each node (counting
+// the links to its parent and its children) does not exceed
+// maxDegree, where that is possible with a breadth-first
+// construction.  Nodes that can only be reached through nodes that
+// are already at the limit are attached to the least loaded of those
+// nodes.
+//
+// Stable if the graph is stable.
+func MakeDegreeBoundedSpanningTree[N cmp.Ordered](g GraphOf[N], root N, maxDegree int) TreeOf[N] {
+	res := TreeOf[N]{root: &TreeNodeOf[N]{id: root}}
+	degree := func(tn *TreeNodeOf[N]) int {
+		d := len(tn.children)
+		if tn.parent != nil {
+			d++
+		}
+		return d
+	}
+
+	todo := []N{root}
+
+	// Nodes reached only through full nodes, and those nodes
+	var blocked []N
+	blockedBy := make(map[N][]*TreeNodeOf[N])
+
+	for {
+		for len(todo) > 0 {
+			parent := res[todo[0]]
+			todo = todo[1:]
+
+			for _, n := range g.Edges(parent.id) {
+				if res[n] != nil {
+					continue
+				}
+
+				if degree(parent) < maxDegree {
+					res[n] = parent.addChild(n)
+					todo = append(todo, n)
+					continue
+				}
+
+				if blockedBy[n] == nil {
+					blocked = append(blocked, n)
+				}
+				blockedBy[n] = append(blockedBy[n], parent)
+			}
+		}
+
+		// Attach the first blocked node that is still detached
+		for len(blocked) > 0 && res[blocked[0]] != nil {
+			blocked = blocked[1:]
+		}
+
+		if len(blocked) == 0 {
+			return res
+		}
+
+		n := blocked[0]
+		best := blockedBy[n][0]
+		for _, p := range blockedBy[n][1:] {
+			if degree(p) < degree(best) {
+				best = p
+			}
+		}
+
+		res[n] = best.addChild(n)
+		todo = append(todo, n)
+	}
+}
+
+// Produce a minimum spanning tree of the weighted graph, rooted at
+// the given node, using Prim's algorithm.  Ties are broken by NodeID.
+// g should be symmetric, including its weights.
+//
+// Stable if the graph is stable.
+func MakeMinimumSpanningTree[N cmp.Ordered](g GraphOf[N], root N) TreeOf[N] {
+	res := TreeOf[N]{root: &TreeNodeOf[N]{id: root}}
+	candidates := &edgeHeap[N]{}
+
+	addEdges := func(tn *TreeNodeOf[N]) {
+		for _, n := range g.Edges(tn.id) {
+			if res[n] == nil {
+				heap.Push(candidates, weightedEdge[N]{
+					from:   tn,
+					to:     n,
+					weight: g.EdgeWeight(tn.id, n),
+				})
+			}
+		}
+	}
+
+	addEdges(res[root])
+	for candidates.Len() > 0 {
+		e := heap.Pop(candidates).(weightedEdge[N])
+		if res[e.to] == nil {
+			res[e.to] = e.from.addChild(e.to)
+			addEdges(res[e.to])
+		}
+	}
+
+	return res
+}
+
+type weightedEdge[N cmp.Ordered] struct {
+	from   *TreeNodeOf[N]
+	to     N
+	weight int
+}
+
+type edgeHeap[N cmp.Ordered] []weightedEdge[N]
+
+func (h edgeHeap[N]) Len() int { return len(h) }
+
+func (h edgeHeap[N]) Less(i, j int) bool {
+	a := h[i]
+	b := h[j]
+	if a.weight != b.weight {
+		return a.weight < b.weight
+	} else if a.to != b.to {
+		return a.to < b.to
+	} else {
+		return a.from.id < b.from.id
+	}
+}
+
+func (h edgeHeap[N]) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *edgeHeap[N]) Push(x interface{}) {
+	*h = append(*h, x.(weightedEdge[N]))
+}
+
+func (h *edgeHeap[N]) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,150 @@
+package graph
+
+import (
+	"cmp"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+// Topology statistics of a (symmetric) graph.  Distances are hop
+// counts, ignoring edge weights.  If the graph is not connected, the
+// eccentricity of a node is taken over the nodes reachable from it.
+type StatisticsOf[N cmp.Ordered] struct {
+	Nodes int
+
+	// The number of links, i.e. pairs of adjacent nodes
+	Links int
+
+	Connected bool
+
+	// The maximum and minimum eccentricities of the nodes, and
+	// the nodes with the minimum eccentricity
+	Diameter int
+	Radius   int
+	Center   []N
+
+	// The number of nodes with each degree.  Self-loops do not
+	// count towards the degree of a node.
+	DegreeDistribution map[int]int
+
+	// The mean distance between pairs of distinct nodes that are
+	// reachable from each other
+	AveragePathLength float64
+}
+
+type Statistics = StatisticsOf[NodeID]
+
+// Compute exact statistics for a graph.  This requires a breadth-first
+// search from every node, which are run in parallel.
+func Stats[N cmp.Ordered](g GraphOf[N]) StatisticsOf[N] {
+	ig := NewIndexed(g)
+	n := ig.Len()
+	res := StatisticsOf[N]{
+		Nodes:              n,
+		Connected:          true,
+		DegreeDistribution: make(map[int]int),
+	}
+
+	edges := 0
+	for i := 0; i < n; i++ {
+		degree := 0
+		for _, j := range ig.Edges(i) {
+			if j != i {
+				degree++
+			}
+		}
+
+		edges += degree
+		res.DegreeDistribution[degree]++
+	}
+	res.Links = edges / 2
+
+	if n == 0 {
+		return res
+	}
+
+	eccs := make([]int, n)
+	sums := make([]int64, n)
+	reached := make([]int, n)
+
+	var next int64
+	var wg sync.WaitGroup
+	for w := runtime.GOMAXPROCS(0); w > 0; w-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dist := make([]int, n)
+			queue := make([]int, 0, n)
+			for {
+				s := int(atomic.AddInt64(&next, 1) - 1)
+				if s >= n {
+					return
+				}
+
+				eccs[s], sums[s], reached[s] = bfsDistances(ig, s, dist, queue)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var sum int64
+	pairs := 0
+	res.Radius = MaxInt
+	for i := 0; i < n; i++ {
+		if reached[i] < n {
+			res.Connected = false
+		}
+
+		if eccs[i] > res.Diameter {
+			res.Diameter = eccs[i]
+		}
+
+		if eccs[i] < res.Radius {
+			res.Radius = eccs[i]
+			res.Center = nil
+		}
+
+		if eccs[i] == res.Radius {
+			res.Center = append(res.Center, ig.IDs[i])
+		}
+
+		sum += sums[i]
+		pairs += reached[i] - 1
+	}
+
+	if pairs > 0 {
+		res.AveragePathLength = float64(sum) / float64(pairs)
+	}
+
+	return res
+}
+
+// A breadth-first search from s, returning the eccentricity of s, the
+// sum of the distances to the nodes reached, and the number of nodes
+// reached (including s).  dist and queue are scratch space.
+func bfsDistances[N cmp.Ordered](ig *IndexedOf[N], s int, dist []int, queue []int) (int, int64, int) {
+	for i := range dist {
+		dist[i] = -1
+	}
+
+	dist[s] = 0
+	queue = append(queue[:0], s)
+	var sum int64
+	ecc := 0
+	for head := 0; head < len(queue); head++ {
+		u := queue[head]
+		for _, v := range ig.Edges(u) {
+			if dist[v] < 0 {
+				dist[v] = dist[u] + 1
+				ecc = dist[v]
+				sum += int64(dist[v])
+				queue = append(queue, v)
+			}
+		}
+	}
+
+	return ecc, sum, len(queue)
+}
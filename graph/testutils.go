@@ -1,6 +1,7 @@
 package graph
 
 import (
+	"cmp"
 	"math/rand"
 	"sort"
 	"strconv"
@@ -8,25 +9,27 @@ import (
 	. "github.com/dpw/monotreme/rudiments"
 )
 
-func MapGraph(g map[NodeID][]NodeID) Graph {
-	var res []NodeID
+func MapGraph[N cmp.Ordered](g map[N][]N) GraphOf[N] {
+	var res []N
 
 	for n := range g {
 		res = append(res, n)
 	}
 
-	return Graph{
-		Nodes: SortNodeIDs(res),
-		Edges: func(id NodeID) []NodeID {
+	return GraphOf[N]{
+		Nodes: sortNodes(res),
+		Edges: func(id N) []N {
 			return g[id]
 		},
 	}
 }
 
-type Edge struct {
-	A, B NodeID
+type EdgeOf[N cmp.Ordered] struct {
+	A, B N
 }
 
+type Edge = EdgeOf[NodeID]
+
 // An undirected graph represented as a set of edges.  The edge pairs
 // are sorted.
 type Undirected struct {
@@ -34,15 +37,15 @@ type Undirected struct {
 	Edges map[Edge]struct{}
 }
 
-func (e Edge) Reverse() Edge {
-	return Edge{e.B, e.A}
+func (e EdgeOf[N]) Reverse() EdgeOf[N] {
+	return EdgeOf[N]{e.B, e.A}
 }
 
-func (e Edge) Reflexive() bool {
+func (e EdgeOf[N]) Reflexive() bool {
 	return e.A == e.B
 }
 
-func (e Edge) Canonical() Edge {
+func (e EdgeOf[N]) Canonical() EdgeOf[N] {
 	if e.A <= e.B {
 		return e
 	} else {
@@ -71,11 +74,11 @@ func (u Undirected) Contains(e Edge) bool {
 	return present
 }
 
-type edges []Edge
+type edges[N cmp.Ordered] []EdgeOf[N]
 
-func (es edges) Len() int { return len(es) }
+func (es edges[N]) Len() int { return len(es) }
 
-func (es edges) Less(i, j int) bool {
+func (es edges[N]) Less(i, j int) bool {
 	if es[i].A < es[j].A {
 		return true
 	} else if es[i].A > es[j].A {
@@ -85,14 +88,14 @@ func (es edges) Less(i, j int) bool {
 	}
 }
 
-func (es edges) Swap(i, j int) {
+func (es edges[N]) Swap(i, j int) {
 	t := es[i]
 	es[i] = es[j]
 	es[j] = t
 }
 
 func (u Undirected) SortedEdges() []Edge {
-	var es edges
+	var es edges[NodeID]
 
 	for e := range u.Edges {
 		es = append(es, e)
@@ -124,7 +127,7 @@ func (u Undirected) Graph() Graph {
 	return Graph{
 		Nodes: u.Nodes,
 		Edges: func(id NodeID) []NodeID {
-			return SortNodeIDs(g[id])
+			return sortNodes(g[id])
 		},
 	}
 }
@@ -0,0 +1,129 @@
+package graph
+
+import (
+	"cmp"
+	"container/heap"
+)
+
+// Dijkstra's algorithm to find shortest paths in a weighted graph.
+// Edge weights must not be negative.  The Distance of each result is
+// the total weight of the path.
+//
+// Stable if the Graph g is stable.
+func FindWeightedShortestPaths[N cmp.Ordered](g GraphOf[N], start N) map[N]ShortestPathOf[N] {
+	res := make(map[N]ShortestPathOf[N])
+	todo := &pathHeap[N]{{ShortestPathOf[N]{0, start}, start}}
+
+	for todo.Len() > 0 {
+		p := heap.Pop(todo).(path[N])
+		if _, done := res[p.node]; done {
+			continue
+		}
+
+		res[p.node] = p.ShortestPathOf
+		for _, n := range g.Edges(p.node) {
+			if _, done := res[n]; done {
+				continue
+			}
+
+			initial := p.Initial
+			if p.node == start {
+				initial = n
+			}
+
+			heap.Push(todo, path[N]{ShortestPathOf[N]{
+				p.Distance + g.EdgeWeight(p.node, n),
+				initial,
+			}, n})
+		}
+	}
+
+	return res
+}
+
+type path[N cmp.Ordered] struct {
+	ShortestPathOf[N]
+	node N
+}
+
+type pathHeap[N cmp.Ordered] []path[N]
+
+func (h pathHeap[N]) Len() int { return len(h) }
+
+func (h pathHeap[N]) Less(i, j int) bool {
+	a := h[i]
+	b := h[j]
+	if a.Distance != b.Distance {
+		return a.Distance < b.Distance
+	} else if a.node != b.node {
+		return a.node < b.node
+	} else {
+		return a.Initial < b.Initial
+	}
+}
+
+func (h pathHeap[N]) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *pathHeap[N]) Push(x interface{}) {
+	*h = append(*h, x.(path[N]))
+}
+
+func (h *pathHeap[N]) Pop() interface{} {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
+
+// A weighted counterpart of MakeBushySpanningTree: Produce a spanning
+// tree that attempts to minimise the weighted distance of each node
+// from the given root (i.e. a shortest path tree), while constraining
+// the number of children of each node according to softChildLimit.
+// A node is only attached to a parent that already has
+// softChildLimit children if it cannot be reached in any other way.
+//
+// Stable if the graph is stable.
+func MakeWeightedSpanningTree[N cmp.Ordered](g GraphOf[N], root N, softChildLimit int) TreeOf[N] {
+	res := TreeOf[N]{root: &TreeNodeOf[N]{id: root}}
+	distance := map[N]int{root: 0}
+
+	// The number of candidate parents not yet considered for
+	// each node
+	candidates := make(map[N]int)
+	todo := &edgeHeap[N]{}
+
+	addEdges := func(tn *TreeNodeOf[N]) {
+		for _, n := range g.Edges(tn.id) {
+			if res[n] == nil {
+				candidates[n]++
+				heap.Push(todo, weightedEdge[N]{
+					from: tn,
+					to:   n,
+					weight: distance[tn.id] +
+						g.EdgeWeight(tn.id, n),
+				})
+			}
+		}
+	}
+
+	addEdges(res[root])
+	for todo.Len() > 0 {
+		e := heap.Pop(todo).(weightedEdge[N])
+		if res[e.to] != nil {
+			continue
+		}
+
+		candidates[e.to]--
+		if len(e.from.children) >= softChildLimit &&
+			candidates[e.to] > 0 {
+			// Try the other candidate parents first
+			continue
+		}
+
+		res[e.to] = e.from.addChild(e.to)
+		distance[e.to] = e.weight
+		addEdges(res[e.to])
+	}
+
+	return res
+}
@@ -1,15 +1,126 @@
 package propagation
 
 import (
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"time"
+
 	"github.com/dpw/monotreme/graph"
 	. "github.com/dpw/monotreme/rudiments"
 )
 
+// Parameters of a Connectivity
+type Config struct {
+	// The policy determining the spanning tree.  All nodes must
+	// use the same policy.  Nil means the default policy.
+	TreePolicy TreePolicy
+
+	// Maintain the spanning tree incrementally, so that a
+	// connectivity change disturbs as few tree links as possible,
+	// and the root only moves when another node is more central
+	// by more than the policy's margin.  Only effective if
+	// TreePolicy is an IncrementalTreePolicy.
+	IncrementalTree bool
+
+	// A link's RTT is only propagated to other nodes when it
+	// differs from the RTT last propagated by more than this
+	// fraction, so that jitter does not cause a stream of
+	// connectivity changes.  Changes are not propagated at all if
+	// the tree policy ignores RTTs.
+	RTTChangeThreshold float64
+
+	// The number of membership events to retain for
+	// MembershipEvents
+	MembershipHistory int
+
+	// The number of recomputations for which the state of a node
+	// that has become unreachable is retained, in case it
+	// returns.  Zero means the default.
+	PrunedStateRetention int
+
+	// If not nil, called with each graph computed from the
+	// connectivity states, returning an equal graph to use in its
+	// place.  The simulator uses this to share equal graphs
+	// between its nodes.
+	ShareGraph func(*graph.Indexed) *graph.Indexed
+}
+
+var DefaultConfig = Config{
+	TreePolicy: BushyTreePolicy{
+		Witnesses:      10,
+		SoftChildLimit: 4,
+		RootMargin:     1,
+	},
+	IncrementalTree:      true,
+	RTTChangeThreshold:   0.2,
+	MembershipHistory:    1000,
+	PrunedStateRetention: 1000,
+}
+
+// The state of a node in the connectivity propagation is a []LinkState,
+// sorted by Node, describing the links of the node.
+type LinkState struct {
+	Node NodeID
+
+	// The smoothed round-trip time of the link, or zero if it
+	// has not been measured.
+	RTT time.Duration
+
+	// Whether the link is to the node's parent in the incremental
+	// spanning tree.  See Config.IncrementalTree.
+	Parent bool
+}
+
+// The weight given to a link whose RTT has not been measured by
+// either end.  It is pessimistic, so that a new link does not
+// displace measured links from the spanning tree until its RTT is
+// known.
+const UnmeasuredRTT = time.Second
+
 type Connectivity struct {
 	id       NodeID
+	config   Config
 	connProp *Propagation
 	props    []*Propagation
 	links    map[NodeID]*Link
+
+	// If deferRecompute is set, connectivity changes are coalesced:
+	// see SetDeferRecompute.
+	deferRecompute func()
+	dirty          bool
+
+	// Set while this node announces a new parent, which should not
+	// cause a recomputation of its own
+	announcing bool
+
+	// The number of times the spanning tree has been computed,
+	// and the number of times a link has become or ceased to be a
+	// tree link
+	recomputations  int
+	treeLinkChanges int
+
+	// The incrementally maintained spanning tree, and this node's
+	// parent in it, as announced in its connectivity state
+	tree   graph.Tree
+	parent NodeID
+
+	// The graph from which the spanning tree was last computed,
+	// and the tree computed from scratch, if it has been
+	graph        graph.Graph
+	spanningTree graph.Tree
+
+	// Shortest paths from this node in graph, computed on demand
+	// by shortestPaths
+	paths map[NodeID]graph.ShortestPath
+
+	membership membership
+
+	// This node's place in the spanning tree, and the function to
+	// call when it changes
+	treeInfo     TreeInfo
+	onTreeChange func(TreeInfo)
 }
 
 type Link struct {
@@ -18,19 +129,58 @@ type Link struct {
 	neighbors map[*Propagation]*Neighbor
 	pending   func()
 
+	// The RTT of the link, as propagated, and as last measured
+	rtt         time.Duration
+	measuredRTT time.Duration
+
 	// pendingProps is non-nil when this is a tree link
 	pendingProps map[*Propagation]*Neighbor
+
+	// The propagation that goes first in the next OutgoingBatch
+	nextProp int
 }
 
 func NewConnectivity(id NodeID) *Connectivity {
+	return NewConnectivityWithConfig(id, DefaultConfig)
+}
+
+func NewConnectivityWithConfig(id NodeID, config Config) *Connectivity {
+	if config.TreePolicy == nil {
+		config.TreePolicy = DefaultConfig.TreePolicy
+	}
+
 	c := &Connectivity{
-		id:    id,
-		links: make(map[NodeID]*Link),
+		id:     id,
+		config: config,
+		links:  make(map[NodeID]*Link),
+		membership: membership{
+			unreachable: make(map[NodeID]struct{}),
+		},
 	}
 	c.connProp = newPropagation(c.connectivityChange)
+	if config.PrunedStateRetention > 0 {
+		c.connProp.retainPrunes = uint64(config.PrunedStateRetention)
+	}
+
 	return c
 }
 
+func (c *Connectivity) TreePolicy() TreePolicy {
+	return c.config.TreePolicy
+}
+
+// The name of the tree policy, marked if the tree is maintained
+// incrementally, as nodes must agree about that too
+func (config Config) TreePolicyName() string {
+	name := config.TreePolicy.Name()
+	_, incremental := config.TreePolicy.(IncrementalTreePolicy)
+	if incremental && config.IncrementalTree {
+		name += "+incremental"
+	}
+
+	return name
+}
+
 func (c *Connectivity) ConnectivityPropagation() *Propagation {
 	return c.connProp
 }
@@ -66,8 +216,32 @@ func (link *Link) Close() {
 	link.c.linksChanged()
 }
 
+// Record the smoothed RTT of the link.  The first measurement is
+// propagated to other nodes, but later changes are only propagated if
+// the tree policy uses the edge weights.
+func (link *Link) SetRTT(rtt time.Duration) {
+	link.measuredRTT = rtt
+
+	diff := rtt - link.rtt
+	if diff < 0 {
+		diff = -diff
+	}
+
+	if link.rtt == 0 || (link.c.config.TreePolicy.Weighted() &&
+		float64(diff) > float64(link.rtt)*link.c.config.RTTChangeThreshold) {
+		link.rtt = rtt
+		link.c.linksChanged()
+	}
+}
+
 func (c *Connectivity) linksChanged() {
-	c.connProp.Set(c.id, graph.SortNodeIDs(c.linkNodeIDs()))
+	var state []LinkState
+	for _, n := range graph.SortNodeIDs(c.linkNodeIDs()) {
+		state = append(state, LinkState{Node: n, RTT: c.links[n].rtt,
+			Parent: n == c.parent})
+	}
+
+	c.connProp.Set(c.id, state)
 }
 
 func (c *Connectivity) linkNodeIDs() []NodeID {
@@ -78,10 +252,83 @@ func (c *Connectivity) linkNodeIDs() []NodeID {
 	return links
 }
 
+// Defer the recomputation of the spanning tree after connectivity
+// changes, so that a burst of changes can be coalesced.  When deferred
+// is non-nil, a change only marks the Connectivity as dirty, calling
+// deferred if it was clean, and the caller is responsible for calling
+// Recompute later.  In the meantime, updates continue to be sent over
+// the existing tree links.
+func (c *Connectivity) SetDeferRecompute(deferred func()) {
+	c.deferRecompute = deferred
+	if deferred == nil {
+		c.Recompute()
+	}
+}
+
+// Recompute the spanning tree, if there have been changes since it
+// was last computed.
+func (c *Connectivity) Recompute() {
+	if c.dirty {
+		c.dirty = false
+		c.recompute()
+	}
+}
+
 func (c *Connectivity) connectivityChange() {
+	if c.announcing {
+		return
+	}
+
+	if c.deferRecompute == nil {
+		c.recompute()
+		return
+	}
+
+	if !c.dirty {
+		c.dirty = true
+		c.deferRecompute()
+	}
+
+	c.checkPending(c.connProp)
+}
+
+// The most times the spanning tree is computed for one connectivity
+// change, as each new parent this node announces in the incremental
+// tree leads to another computation.
+const maxRecomputeRounds = 8
+
+func (c *Connectivity) recompute() {
+	// Announcing a new parent changes the announced parents from
+	// which the incremental tree is updated.  Usually the tree is
+	// then unchanged, but UpdateTree need not reach a fixed point,
+	// e.g. while the announced parents contain cycles, so the
+	// rounds are bounded.  The nodes whose connectivity states
+	// change later recompute anyway.
+	for round := 0; round < maxRecomputeRounds; round++ {
+		c.computeTree()
+		if !c.announceParent() {
+			return
+		}
+	}
+
+	c.checkPending(c.connProp)
+}
+
+func (c *Connectivity) computeTree() {
+	c.recomputations++
+
 	// reachability prune
+	states := make(map[NodeID][]LinkState)
 	g := graph.ReachableGraph(c.id, func(node NodeID) []NodeID {
-		return c.connProp.Get(node, []NodeID(nil)).([]NodeID)
+		state := c.connProp.getRetained(node, []LinkState(nil)).([]LinkState)
+		states[node] = state
+
+		edges := make([]NodeID, len(state))
+		for i, ls := range state {
+			edges[i] = ls.Node
+		}
+
+		return edges
 	})
 
 	// The graph g might not be symmetric, as we might hear that
@@ -115,28 +362,71 @@ func (c *Connectivity) connectivityChange() {
 		},
 	}
 
-	local = local.Union(local.Transpose())
-
-	g = g.Intersect(g.Transpose()).Union(local)
+	// Materialize the graphs, so that the tree computation does
+	// not repeatedly evaluate a stack of closures.  The weights
+	// are materialized too, so that the graph does not retain the
+	// link states.
+	ig := graph.NewIndexed(g)
+	il := graph.NewIndexed(local)
+	ig = ig.Intersect(ig.Transpose()).Union(il.Union(il.Transpose()))
+	ig = ig.WithWeights(func(from, to NodeID) int {
+		return linkWeight(linkRTT(states[from], to),
+			linkRTT(states[to], from))
+	})
+	if c.config.ShareGraph != nil {
+		ig = c.config.ShareGraph(ig)
+	}
 
+	g = ig.Graph()
+	c.graph = g
+	c.paths = nil
 	c.connProp.prune(g)
 	for _, p := range c.props {
 		p.prune(g)
 	}
 
-	// recompute spanning tree
-	pcn := graph.FindPseudoCentralNode(g, 10)
-	t := graph.MakeBushySpanningTree(g, pcn, 4)
+	c.updateMembership()
+
+	// Updates are propagated over the links of the incremental
+	// tree if there is one, and otherwise the scratch tree.  The
+	// nodes must agree about the incremental tree, as they do
+	// about the scratch tree, or updates might not reach every
+	// node.  So rather than each node keeping its own previous
+	// tree, the tree is built from the parents announced in the
+	// connectivity states, and this node announces its new
+	// parent below.
+	policy, incremental := c.config.TreePolicy.(IncrementalTreePolicy)
+	if c.config.IncrementalTree && incremental {
+		c.tree = policy.UpdateTree(c.announcedParents(g), g)
+
+		// The tree computed from scratch is then only for
+		// SpanningTree, which builds it on demand
+		c.spanningTree = nil
+	} else {
+		c.spanningTree = c.config.TreePolicy.BuildTree(g)
+	}
+
+	propTree := c.PropagationTree()
 
 	treeLinks := make(map[NodeID]struct{})
-	for _, n := range t.Undirected().Edges(c.id) {
+	for _, n := range propTree.Links(c.id) {
 		treeLinks[n] = struct{}{}
 	}
 
+	c.updateTreeInfo(propTree)
+
 	for n, link := range c.links {
 		if _, present := treeLinks[n]; present {
+			if link.pendingProps == nil {
+				c.treeLinkChanges++
+			}
+
 			link.pendingProps = make(map[*Propagation]*Neighbor)
 		} else {
+			if link.pendingProps != nil {
+				c.treeLinkChanges++
+			}
+
 			link.pendingProps = nil
 			for _, neighbor := range link.neighbors {
 				neighbor.deactivate()
@@ -147,6 +437,282 @@ func (c *Connectivity) connectivityChange() {
 	c.checkPending(c.connProp)
 }
 
+// Announce this node's parent in the incremental tree, if it has
+// changed, without recomputing the tree.  Returns whether it changed.
+func (c *Connectivity) announceParent() bool {
+	if c.tree == nil {
+		return false
+	}
+
+	parent, _ := c.tree.Parent(c.id)
+	if parent == c.parent {
+		return false
+	}
+
+	c.parent = parent
+	c.announcing = true
+	c.linksChanged()
+	c.announcing = false
+	return true
+}
+
+// The parents in the incremental tree announced by the nodes of g
+func (c *Connectivity) announcedParents(g graph.Graph) map[NodeID]NodeID {
+	parents := make(map[NodeID]NodeID)
+	for _, n := range g.Nodes {
+		state, _ := c.connProp.Get(n, nil).([]LinkState)
+		for _, ls := range state {
+			if ls.Parent {
+				parents[n] = ls.Node
+				break
+			}
+		}
+	}
+
+	return parents
+}
+
+// The weight of a link in the graph used to build the spanning tree,
+// in microseconds.  The two ends of a link might report different
+// RTTs, but all nodes must agree on the weight, so it is symmetric.
+func linkWeight(a, b time.Duration) int {
+	rtt := a
+	if b > rtt {
+		rtt = b
+	}
+
+	if rtt == 0 {
+		rtt = UnmeasuredRTT
+	}
+
+	if w := int(rtt / time.Microsecond); w > 0 {
+		return w
+	}
+
+	return 1
+}
+
+// The RTT that a node's link state reports for its link to node, or
+// zero if it reports none
+func linkRTT(state []LinkState, node NodeID) time.Duration {
+	for _, ls := range state {
+		if ls.Node == node {
+			return ls.RTT
+		}
+	}
+
+	return 0
+}
+
+// The number of times the spanning tree has been computed
+func (c *Connectivity) Recomputations() int {
+	return c.recomputations
+}
+
+// The graph from which the spanning tree was last computed.  It is
+// not modified afterwards, so it can be used from other goroutines.
+func (c *Connectivity) Graph() graph.Graph {
+	return c.graph
+}
+
+// The spanning tree as last computed from scratch by the TreePolicy.
+// Like Graph, it is not modified afterwards.
+func (c *Connectivity) SpanningTree() graph.Tree {
+	if c.spanningTree == nil && c.graph.Edges != nil {
+		c.spanningTree = c.config.TreePolicy.BuildTree(c.graph)
+	}
+
+	return c.spanningTree
+}
+
+// The spanning tree over which updates are propagated: the
+// incremental tree with Config.IncrementalTree, and otherwise the
+// same as SpanningTree.  Like Graph, it is not modified afterwards.
+func (c *Connectivity) PropagationTree() graph.Tree {
+	if c.tree != nil {
+		return c.tree
+	}
+
+	return c.spanningTree
+}
+
+// This node's place in the spanning tree
+type TreeInfo struct {
+	Root NodeID
+
+	// The parent of this node, or empty if it is the root
+	Parent   NodeID
+	Children []NodeID
+
+	// The number of links between this node and the root
+	Depth int
+
+	// The links over which this node propagates updates: The
+	// links to the parent and children
+	Links []NodeID
+}
+
+func (ti TreeInfo) equal(other TreeInfo) bool {
+	return ti.Root == other.Root && ti.Parent == other.Parent &&
+		ti.Depth == other.Depth &&
+		slices.Equal(ti.Children, other.Children) &&
+		slices.Equal(ti.Links, other.Links)
+}
+
+// This node's place in the spanning tree over which updates are
+// propagated: the incremental tree with Config.IncrementalTree, and
+// otherwise the tree computed from scratch.  The nodes agree about
+// it once they agree about the connectivity states.  Zero until the
+// first computation.
+func (c *Connectivity) TreeInfo() TreeInfo {
+	return c.treeInfo
+}
+
+// Call f with the new TreeInfo whenever it changes.
+func (c *Connectivity) SetTreeInfoFunc(f func(TreeInfo)) {
+	c.onTreeChange = f
+}
+
+func (c *Connectivity) updateTreeInfo(t graph.Tree) {
+	ti := TreeInfo{
+		Root:     t.Root(),
+		Children: t.Children(c.id),
+		Depth:    t.Depth(c.id),
+	}
+	ti.Parent, _ = t.Parent(c.id)
+	ti.Links = t.Links(c.id)
+
+	if !ti.equal(c.treeInfo) {
+		c.treeInfo = ti
+		if c.onTreeChange != nil {
+			c.onTreeChange(ti)
+		}
+	}
+}
+
+// Write the topology of the cluster as seen by this node, in
+// Graphviz DOT format, highlighting the spanning tree over which
+// updates are propagated.
+func (c *Connectivity) WriteDOT(w io.Writer) error {
+	return graph.WriteTreeDOT(w, c.graph, c.PropagationTree())
+}
+
+// Write the topology of the cluster as seen by this node, as JSON,
+// including the spanning tree over which updates are propagated.
+func (c *Connectivity) WriteJSON(w io.Writer) error {
+	return graph.WriteTreeJSON(w, c.graph, c.PropagationTree())
+}
+
+// The nodes of the local links that are bridges: links whose failure
+// would partition the cluster.  Based on the graph as of the last
+// computation of the spanning tree.
+func (c *Connectivity) BridgeLinks() []NodeID {
+	var res []NodeID
+	for _, e := range graph.Bridges(c.graph) {
+		if e.A == c.id {
+			res = append(res, e.B)
+		} else if e.B == c.id {
+			res = append(res, e.A)
+		}
+	}
+
+	return graph.SortNodeIDs(res)
+}
+
+// The nodes to which this node should add links to make the cluster
+// k-edge-connected, as suggested by graph.SuggestLinks.  Based on the
+// graph as of the last computation of the spanning tree, so all nodes
+// that agree about the graph agree about the suggestions.
+func (c *Connectivity) SuggestedLinks(k int) []NodeID {
+	var res []NodeID
+	for _, e := range graph.SuggestLinks(c.graph, k, 0) {
+		if e.A == c.id {
+			res = append(res, e.B)
+		} else if e.B == c.id {
+			res = append(res, e.A)
+		}
+	}
+
+	return graph.SortNodeIDs(res)
+}
+
+// A member of the cluster, as seen by this node
+type Member struct {
+	Node NodeID
+
+	// The version of the node's connectivity state, and the links
+	// it reports.  A neighbor that has not reported its state yet
+	// has no links.
+	Version Version
+	Links   []LinkState
+
+	// The number of hops from this node
+	Hops int
+}
+
+// The members of the cluster: the nodes reachable from this node over
+// links that both ends report, sorted by NodeID.  Like BridgeLinks,
+// it is based on the graph as of the last computation of the spanning
+// tree, so until the first computation, this node is the only member.
+func (c *Connectivity) Members() []Member {
+	if c.graph.Edges == nil {
+		return []Member{c.member(c.id, 0)}
+	}
+
+	var res []Member
+	for n, path := range c.shortestPaths() {
+		res = append(res, c.member(n, path.Distance))
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Node < res[j].Node })
+	return res
+}
+
+func (c *Connectivity) member(n NodeID, hops int) Member {
+	m := Member{Node: n, Hops: hops}
+	if ns := c.connProp.nodes[n]; ns != nil {
+		m.Version = ns.Version
+		state, _ := ns.State.([]LinkState)
+		m.Links = append([]LinkState(nil), state...)
+	}
+
+	return m
+}
+
+// The nodes directly linked to this node, and their RTTs, sorted by
+// NodeID.  Unlike Members, this reflects the links and their latest
+// RTTs immediately.
+func (c *Connectivity) Neighbors() []LinkState {
+	res := make([]LinkState, 0, len(c.links))
+	for _, n := range graph.SortNodeIDs(c.linkNodeIDs()) {
+		res = append(res, LinkState{Node: n, RTT: c.links[n].measuredRTT})
+	}
+
+	return res
+}
+
+// The neighbor to which to forward a message for dest, along a
+// shortest path in the graph as of the last computation of the
+// spanning tree.  False if dest is this node or is not reachable.
+func (c *Connectivity) NextHop(dest NodeID) (NodeID, bool) {
+	path, present := c.shortestPaths()[dest]
+	if !present || dest == c.id {
+		return "", false
+	}
+
+	return path.Initial, true
+}
+
+// The shortest paths from this node in the graph as of the last
+// computation of the spanning tree, or nil before the first
+func (c *Connectivity) shortestPaths() map[NodeID]graph.ShortestPath {
+	if c.paths == nil && c.graph.Edges != nil {
+		c.paths = graph.FindShortestPaths(c.graph, c.id)
+	}
+
+	return c.paths
+}
+
 func (c *Connectivity) checkPending(prop *Propagation) {
 	// XXX store separate treeLink list
 	for _, link := range c.links {
@@ -176,7 +742,7 @@ func (link *Link) SetPendingFunc(pending func()) {
 	if pending != nil && link.pendingProps != nil {
 		p := false
 		for prop := range link.neighbors {
-			p = (p || link.checkPending(prop))
+			p = link.checkPending(prop) || p
 		}
 
 		if p {
@@ -199,6 +765,69 @@ func (link *Link) Outgoing() map[*Propagation][]Update {
 	return res
 }
 
+// Get at most max of the pending updates for the link, or all of
+// them if max is not positive.  The propagations with pending updates take turns to
+// contribute updates to the batch, and a different propagation goes
+// first on each call, so that a busy propagation cannot starve the
+// others.
+func (link *Link) OutgoingBatch(max int) map[*Propagation][]Update {
+	res := make(map[*Propagation][]Update)
+	if link.pendingProps == nil {
+		return res
+	}
+
+	if max <= 0 {
+		max = math.MaxInt
+	}
+
+	props := append([]*Propagation{link.c.connProp}, link.c.props...)
+	first := link.nextProp % len(props)
+	link.nextProp = first + 1
+
+	var queues [][]Update
+	var queueProps []*Propagation
+	for i := range props {
+		prop := props[(first+i)%len(props)]
+		if n := link.pendingProps[prop]; n != nil {
+			if o := n.outgoing(max); len(o) > 0 {
+				queues = append(queues, o)
+				queueProps = append(queueProps, prop)
+			}
+		}
+	}
+
+	count := 0
+	for round := 0; count < max; round++ {
+		progress := false
+		for i, q := range queues {
+			if round < len(q) && count < max {
+				res[queueProps[i]] = append(res[queueProps[i]],
+					q[round])
+				count++
+				progress = true
+			}
+		}
+
+		if !progress {
+			break
+		}
+	}
+
+	return res
+}
+
+// The number of updates waiting to be sent over the link
+func (link *Link) Backlog() int {
+	backlog := 0
+	if link.pendingProps != nil {
+		for _, n := range link.neighbors {
+			backlog += n.Backlog()
+		}
+	}
+
+	return backlog
+}
+
 func (link *Link) Delivered(prop *Propagation, updates []Update) {
 	n := link.neighbors[prop]
 	if n != nil {
@@ -1,6 +1,7 @@
 package propagation
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 	"testing"
@@ -22,6 +23,12 @@ type sim struct {
 	cs      map[NodeID]*Connectivity
 	links   map[graph.Edge]*link
 	pending []*link
+
+	// If non-zero, recomputation is deferred, and the dirty
+	// Connectivities are recomputed every recomputeInterval
+	// steps.
+	recomputeInterval int
+	dirty             []*Connectivity
 }
 
 func (s *sim) link(e graph.Edge) {
@@ -54,14 +61,25 @@ func (s *sim) disconnect(e graph.Edge) {
 }
 
 func makeSim(g graph.Undirected) *sim {
+	return makeSimWith(g, DefaultConfig, 0)
+}
+
+func makeSimWith(g graph.Undirected, config Config, recomputeInterval int) *sim {
 	sim := &sim{
-		graph: g,
-		cs:    make(map[NodeID]*Connectivity),
-		links: make(map[graph.Edge]*link),
+		graph:             g,
+		cs:                make(map[NodeID]*Connectivity),
+		links:             make(map[graph.Edge]*link),
+		recomputeInterval: recomputeInterval,
 	}
 
 	for _, n := range g.Nodes {
-		sim.cs[n] = NewConnectivity(n)
+		c := NewConnectivityWithConfig(n, config)
+		sim.cs[n] = c
+		if recomputeInterval > 0 {
+			c.SetDeferRecompute(func() {
+				sim.dirty = append(sim.dirty, c)
+			})
+		}
 	}
 
 	for _, e := range g.SortedEdges() {
@@ -71,61 +89,85 @@ func makeSim(g graph.Undirected) *sim {
 	return sim
 }
 
+// Make a graph with the given nodes and undirected edges
+func edgeGraph(nodes []NodeID, edges [][2]NodeID) graph.Undirected {
+	g := graph.Undirected{Nodes: nodes, Edges: make(map[graph.Edge]struct{})}
+	for _, e := range edges {
+		g.Add(graph.Edge{A: e[0], B: e[1]})
+	}
+	return g
+}
+
 func dbg(msg ...interface{}) {
 	//fmt.Println(msg...)
 }
 
 func (s *sim) run(t *testing.T, rng *rand.Rand) {
+	s.propagate(t, rng, true)
+	s.check(t, s.graph.Nodes)
+}
+
+// Deliver updates until there are none pending.  If churn is set,
+// links are randomly added and removed along the way.
+func (s *sim) propagate(t *testing.T, rng *rand.Rand, churn bool) {
 	dbg(s.graph.Graph().Map())
 
 	step := 0
-	for len(s.pending) > 0 {
+	for {
+		if len(s.dirty) > 0 && (len(s.pending) == 0 ||
+			step%s.recomputeInterval == 0) {
+			dirty := s.dirty
+			s.dirty = nil
+			for _, c := range dirty {
+				c.Recompute()
+			}
+		}
+
+		if len(s.pending) == 0 {
+			break
+		}
+
 		if step > 1000000 {
 			t.Fatal("non-convergence")
 		}
 		step++
 
 		// Maybe add or remove a link
-		if rng.Intn(100) == 0 {
-			e := s.graph.RandomEdge(rng)
-			if s.graph.Contains(e) {
-				s.graph.Remove(e)
-
-				// Check that the graph did not become
-				// disconnected.
-				if s.graph.Graph().Connected() {
-					dbg("Disconnecting", e)
-					s.disconnect(e)
-				} else {
-					s.graph.Add(e)
-				}
-			} else {
-				dbg("Connecting", e)
-				s.graph.Add(e)
-				s.link(e)
-			}
+		if churn && rng.Intn(100) == 0 {
+			s.changeRandomEdge(rng)
 		}
 
 		// Propagate an update
-		i := rng.Intn(len(s.pending))
-		l := s.pending[i]
-		s.pending[i] = s.pending[len(s.pending)-1]
-		s.pending = s.pending[:len(s.pending)-1]
+		s.deliver(rng.Intn(len(s.pending)))
+	}
+}
 
-		if l.closed {
-			continue
-		}
+// Add or remove a random link, unless that would disconnect the graph
+func (s *sim) changeRandomEdge(rng *rand.Rand) {
+	e := s.graph.RandomEdge(rng)
+	if s.graph.Contains(e) {
+		s.graph.Remove(e)
 
-		for prop, updates := range l.sender.Outgoing() {
-			dbg(l.sender.c.id, "->", l.receiver.c.id, ":", updates)
-			l.receiver.Incoming(l.receiver.c.ConnectivityPropagation(), updates)
-			l.sender.Delivered(prop, updates)
+		// Check that the graph did not become
+		// disconnected.
+		if s.graph.Graph().Connected() {
+			dbg("Disconnecting", e)
+			s.disconnect(e)
+		} else {
+			s.graph.Add(e)
 		}
+	} else {
+		dbg("Connecting", e)
+		s.graph.Add(e)
+		s.link(e)
 	}
+}
 
+// Check that the given nodes agree on the connectivity states
+func (s *sim) check(t *testing.T, nodes []NodeID) {
 	var expect map[NodeID]interface{}
 	var expectNode NodeID
-	for _, node := range s.graph.Nodes {
+	for _, node := range nodes {
 		c := s.cs[node]
 		if expect == nil {
 			expect = c.Dump()
@@ -136,6 +178,30 @@ func (s *sim) run(t *testing.T, rng *rand.Rand) {
 	}
 }
 
+// Deliver pending updates until there are none left
+func (s *sim) converge() {
+	for len(s.pending) > 0 {
+		s.deliver(0)
+	}
+}
+
+// Deliver the updates of the i'th pending link
+func (s *sim) deliver(i int) {
+	l := s.pending[i]
+	s.pending[i] = s.pending[len(s.pending)-1]
+	s.pending = s.pending[:len(s.pending)-1]
+
+	if l.closed {
+		return
+	}
+
+	for prop, updates := range l.sender.Outgoing() {
+		dbg(l.sender.c.id, "->", l.receiver.c.id, ":", updates)
+		l.receiver.Incoming(l.receiver.c.ConnectivityPropagation(), updates)
+		l.sender.Delivered(prop, updates)
+	}
+}
+
 var seed int64
 
 func makeRNG(msg string) *rand.Rand {
@@ -158,3 +224,553 @@ func TestConnectivity(t *testing.T) {
 	}
 
 }
+
+func TestScratchTreeConnectivity(t *testing.T) {
+	config := DefaultConfig
+	config.IncrementalTree = false
+	for i := 0; i < 50; i++ {
+		rng := makeRNG("TestScratchTreeConnectivity dense")
+		makeSimWith(graph.GenerateDense(rng, 7), config, 0).run(t, rng)
+		rng = makeRNG("TestScratchTreeConnectivity sparse")
+		makeSimWith(graph.GenerateSparse(rng, 7), config, 0).run(t, rng)
+	}
+}
+
+func (s *sim) treeLinkChanges() int {
+	res := 0
+	for _, c := range s.cs {
+		res += c.treeLinkChanges
+	}
+	return res
+}
+
+// Change links in a converged cluster, one at a time, and count the
+// times a link became or ceased to be a tree link
+func (s *sim) churn(t *testing.T, rng *rand.Rand, changes int) int {
+	before := s.treeLinkChanges()
+	for i := 0; i < changes; i++ {
+		s.changeRandomEdge(rng)
+		s.propagate(t, rng, false)
+		s.check(t, s.graph.Nodes)
+	}
+
+	return s.treeLinkChanges() - before
+}
+
+func TestIncrementalTreeLinkChanges(t *testing.T) {
+	config := DefaultConfig
+	config.IncrementalTree = false
+	scratch := 0
+	incremental := 0
+
+	for i := 0; i < 5; i++ {
+		seed := makeRNG("TestIncrementalTreeLinkChanges").Int63()
+		rng := rand.New(rand.NewSource(seed))
+		s := makeSimWith(graph.GenerateSparse(rng, 15), config, 0)
+		s.propagate(t, rng, false)
+		scratch += s.churn(t, rng, 20)
+
+		rng = rand.New(rand.NewSource(seed))
+		s = makeSim(graph.GenerateSparse(rng, 15))
+		s.propagate(t, rng, false)
+		incremental += s.churn(t, rng, 20)
+	}
+
+	dbg("tree link changes: scratch", scratch, "incremental", incremental)
+	require.True(t, incremental < scratch)
+}
+
+// An incremental tree policy whose root moves on every update, so
+// that the tree never settles
+type restlessTreePolicy struct {
+	BushyTreePolicy
+	updates *int
+}
+
+func (p restlessTreePolicy) UpdateTree(parents map[NodeID]NodeID, g graph.Graph) graph.Tree {
+	*p.updates++
+	root := g.Nodes[*p.updates%len(g.Nodes)]
+	return graph.MakeBushySpanningTree(g, root, p.SoftChildLimit)
+}
+
+func TestUnsettledParent(t *testing.T) {
+	config := DefaultConfig
+	policy := restlessTreePolicy{config.TreePolicy.(BushyTreePolicy), new(int)}
+	config.TreePolicy = policy
+
+	// The root of the star moves between a and its neighbors, so
+	// a's parent changes with each update, but the recomputation
+	// ends
+	c := NewConnectivityWithConfig("a", config)
+	c.Link("b")
+	c.Link("c")
+	before := c.Recomputations()
+	c.Link("d")
+	require.Equal(t, maxRecomputeRounds, c.Recomputations()-before)
+	require.Equal(t, *policy.updates, c.Recomputations())
+}
+
+func TestDefaultTreePolicy(t *testing.T) {
+	c := NewConnectivityWithConfig("a", Config{})
+	require.Equal(t, DefaultConfig.TreePolicy, c.TreePolicy())
+	c.Link("b")
+	require.NotNil(t, c.SpanningTree()["a"])
+}
+
+func TestTreePolicies(t *testing.T) {
+	policies := []TreePolicy{
+		DefaultConfig.TreePolicy,
+		BFSTreePolicy{Witnesses: 10},
+		DegreeBoundedTreePolicy{Witnesses: 10, MaxDegree: 3},
+		MinimumSpanningTreePolicy{Witnesses: 10},
+		WeightedTreePolicy{Witnesses: 10, SoftChildLimit: 4},
+	}
+
+	for _, policy := range policies {
+		config := Config{TreePolicy: policy}
+		for i := 0; i < 20; i++ {
+			rng := makeRNG("TestTreePolicies " + policy.Name())
+			makeSimWith(graph.GenerateDense(rng, 7), config, 0).run(t, rng)
+			makeSimWith(graph.GenerateSparse(rng, 7), config, 0).run(t, rng)
+		}
+	}
+}
+
+func (s *sim) recomputations() int {
+	res := 0
+	for _, c := range s.cs {
+		res += c.recomputations
+	}
+	return res
+}
+
+// Disconnect a node from the converged cluster, and then reconnect
+// it.  Returns the number of recomputations that took.
+func (s *sim) leaveAndRejoin(t *testing.T, rng *rand.Rand, node NodeID) int {
+	before := s.recomputations()
+
+	var edges []graph.Edge
+	for _, e := range s.graph.SortedEdges() {
+		if e.A == node || e.B == node {
+			edges = append(edges, e)
+			s.graph.Remove(e)
+			s.disconnect(e)
+		}
+	}
+
+	var others []NodeID
+	for _, n := range s.graph.Nodes {
+		if n != node {
+			others = append(others, n)
+		}
+	}
+
+	s.propagate(t, rng, false)
+	s.check(t, others)
+	require.NotContains(t, s.cs[others[0]].Dump(), node)
+
+	for _, e := range edges {
+		s.graph.Add(e)
+		s.link(e)
+	}
+
+	s.propagate(t, rng, false)
+	s.check(t, s.graph.Nodes)
+	return s.recomputations() - before
+}
+
+// A node whose departure would leave the rest of the graph connected
+func leafNode(g graph.Undirected) NodeID {
+	edges := g.Graph().Edges
+	for _, node := range g.Nodes {
+		start := g.Nodes[0]
+		if start == node {
+			start = g.Nodes[1]
+		}
+
+		rest := graph.ReachableGraph(start, func(n NodeID) []NodeID {
+			var res []NodeID
+			for _, m := range edges(n) {
+				if m != node {
+					res = append(res, m)
+				}
+			}
+			return res
+		})
+		if len(rest.Nodes) == len(g.Nodes)-1 {
+			return node
+		}
+	}
+
+	panic("no leaf node")
+}
+
+func TestDeferredRecompute(t *testing.T) {
+	immediate := 0
+	deferred := 0
+
+	for i := 0; i < 20; i++ {
+		seed := makeRNG("TestDeferredRecompute").Int63()
+		g := graph.GenerateSparse(rand.New(rand.NewSource(seed)), 10)
+		node := leafNode(g)
+
+		s := makeSim(g)
+		s.propagate(t, rand.New(rand.NewSource(seed)), false)
+		immediate += s.leaveAndRejoin(t, rand.New(rand.NewSource(seed)), node)
+
+		g = graph.GenerateSparse(rand.New(rand.NewSource(seed)), 10)
+		s = makeSimWith(g, DefaultConfig, 20)
+		s.propagate(t, rand.New(rand.NewSource(seed)), false)
+		deferred += s.leaveAndRejoin(t, rand.New(rand.NewSource(seed)), node)
+	}
+
+	dbg("recomputations: immediate", immediate, "deferred", deferred)
+	require.True(t, deferred < immediate)
+}
+
+func TestPrunedStateRetention(t *testing.T) {
+	prop := newPropagation(func() {})
+	prop.retainPrunes = 2
+	prop.Set("a", 1)
+	prop.Set("b", 2)
+
+	with := graph.Graph{Nodes: []NodeID{"a", "b"}, Edges: func(n NodeID) []NodeID {
+		return []NodeID{n}
+	}}
+	without := graph.Graph{Nodes: []NodeID{"a"}, Edges: func(n NodeID) []NodeID {
+		if n == "a" {
+			return []NodeID{n}
+		}
+		return nil
+	}}
+
+	// A state is restored if its node returns in time
+	prop.prune(without)
+	require.Nil(t, prop.Get("b", nil))
+	require.Equal(t, 2, prop.getRetained("b", nil))
+	prop.prune(without)
+	prop.prune(with)
+	require.Equal(t, 2, prop.Get("b", nil))
+
+	// But discarded otherwise: pruned, and then retained through
+	// two more calls
+	for i := 0; i < 4; i++ {
+		prop.prune(without)
+	}
+	require.Nil(t, prop.getRetained("b", nil))
+	require.Empty(t, prop.pruned)
+	prop.prune(with)
+	require.Nil(t, prop.Get("b", nil))
+	require.Equal(t, 1, prop.Get("a", nil))
+}
+
+func TestOutgoingBatch(t *testing.T) {
+	c := NewConnectivity("a")
+	prop := newPropagation(func() {})
+	c.props = append(c.props, prop)
+
+	link := c.Link("b")
+	for i := 0; i < 10; i++ {
+		prop.Set(NodeID(fmt.Sprint("n", i)), i)
+	}
+
+	link.SetPendingFunc(func() {})
+	require.Equal(t, 11, link.Backlog())
+
+	// Both propagations contribute to a batch
+	batch := link.OutgoingBatch(4)
+	require.Len(t, batch[c.connProp], 1)
+	require.Len(t, batch[prop], 3)
+
+	total := 0
+	for total < 11 {
+		batch = link.OutgoingBatch(4)
+		for p, updates := range batch {
+			require.True(t, len(updates) <= 4)
+			total += len(updates)
+			link.Delivered(p, updates)
+		}
+	}
+
+	require.Equal(t, 0, link.Backlog())
+	require.Len(t, link.OutgoingBatch(4), 0)
+}
+
+func TestLinkRTTs(t *testing.T) {
+	g := edgeGraph([]NodeID{"a", "b", "c"},
+		[][2]NodeID{{"a", "b"}, {"b", "c"}, {"a", "c"}})
+
+	policies := []TreePolicy{
+		MinimumSpanningTreePolicy{Witnesses: 10},
+		WeightedTreePolicy{Witnesses: 10, SoftChildLimit: 4},
+	}
+
+	for _, policy := range policies {
+		config := DefaultConfig
+		config.TreePolicy = policy
+		s := makeSimWith(g, config, 0)
+
+		// The link between a and c is slow
+		for e, l := range s.links {
+			rtt := time.Millisecond
+			if e.Canonical() == (graph.Edge{A: "a", B: "c"}) {
+				rtt = 100 * time.Millisecond
+			}
+
+			l.sender.SetRTT(rtt)
+		}
+
+		s.converge()
+
+		for e, l := range s.links {
+			slow := e.Canonical() == graph.Edge{A: "a", B: "c"}
+			require.Equal(t, slow, l.sender.pendingProps == nil,
+				"%s %v", policy.Name(), e)
+		}
+
+		// Small changes in RTT are not propagated
+		c := s.cs["a"]
+		version := c.connProp.nodes["a"].Version
+		s.links[graph.Edge{A: "a", B: "b"}].sender.SetRTT(1050 * time.Microsecond)
+		require.Equal(t, version, c.connProp.nodes["a"].Version)
+		s.links[graph.Edge{A: "a", B: "b"}].sender.SetRTT(2 * time.Millisecond)
+		require.NotEqual(t, version, c.connProp.nodes["a"].Version)
+	}
+
+	// With a policy that ignores RTTs, only the first measurement
+	// is propagated
+	s := makeSim(g)
+	ab := s.links[graph.Edge{A: "a", B: "b"}].sender
+	c := s.cs["a"]
+	ab.SetRTT(time.Millisecond)
+	version := c.connProp.nodes["a"].Version
+	ab.SetRTT(10 * time.Millisecond)
+	require.Equal(t, version, c.connProp.nodes["a"].Version)
+	state := c.connProp.Get("a", nil).([]LinkState)
+	require.Equal(t, NodeID("b"), state[0].Node)
+	require.Equal(t, time.Millisecond, state[0].RTT)
+	require.Equal(t, 10*time.Millisecond, c.Neighbors()[0].RTT)
+}
+
+func TestBridgeLinks(t *testing.T) {
+	// A triangle with a tail
+	g := edgeGraph([]NodeID{"a", "b", "c", "d"},
+		[][2]NodeID{{"a", "b"}, {"b", "c"}, {"a", "c"}, {"c", "d"}})
+
+	s := makeSim(g)
+	s.converge()
+
+	require.Empty(t, s.cs["a"].BridgeLinks())
+	require.Empty(t, s.cs["b"].BridgeLinks())
+	require.Equal(t, []NodeID{"d"}, s.cs["c"].BridgeLinks())
+	require.Equal(t, []NodeID{"c"}, s.cs["d"].BridgeLinks())
+}
+
+func TestSuggestedLinks(t *testing.T) {
+	// A path
+	g := edgeGraph([]NodeID{"a", "b", "c"},
+		[][2]NodeID{{"a", "b"}, {"b", "c"}})
+
+	s := makeSim(g)
+	s.converge()
+
+	require.Equal(t, []NodeID{"c"}, s.cs["a"].SuggestedLinks(2))
+	require.Empty(t, s.cs["b"].SuggestedLinks(2))
+	require.Equal(t, []NodeID{"a"}, s.cs["c"].SuggestedLinks(2))
+	require.Empty(t, s.cs["a"].SuggestedLinks(1))
+}
+
+func TestMembers(t *testing.T) {
+	// A path, and a node on its own
+	g := edgeGraph([]NodeID{"a", "b", "c", "d"},
+		[][2]NodeID{{"a", "b"}, {"b", "c"}})
+
+	// Before the first computation, a node is on its own
+	require.Equal(t, []Member{{Node: "x"}}, NewConnectivity("x").Members())
+
+	s := makeSim(g)
+	s.converge()
+
+	members := s.cs["a"].Members()
+	require.Len(t, members, 3)
+	for i, n := range []NodeID{"a", "b", "c"} {
+		require.Equal(t, n, members[i].Node)
+		require.Equal(t, i, members[i].Hops)
+		require.NotEmpty(t, members[i].Links)
+	}
+	require.Equal(t, []LinkState{{Node: "a", Parent: true}, {Node: "c"}},
+		members[1].Links)
+
+	require.Equal(t, []LinkState{{Node: "a"}, {Node: "c"}}, s.cs["b"].Neighbors())
+	require.Empty(t, s.cs["d"].Neighbors())
+	require.Equal(t, []Member{{Node: "d"}}, s.cs["d"].Members())
+
+	// Neighbors reflect a link immediately, and members once the
+	// other end reports it
+	s.link(graph.Edge{A: "c", B: "d"})
+	require.Equal(t, []LinkState{{Node: "c"}}, s.cs["d"].Neighbors())
+	s.converge()
+
+	require.Len(t, s.cs["d"].Members(), 4)
+	require.Equal(t, 3, s.cs["a"].Members()[3].Hops)
+}
+
+func TestMembershipEvents(t *testing.T) {
+	config := DefaultConfig
+	config.MembershipHistory = 4
+	c := NewConnectivityWithConfig("a", config)
+	var seen []MembershipEvent
+	c.SetMembershipFunc(func(ev MembershipEvent) { seen = append(seen, ev) })
+
+	link := c.Link("b")
+	incoming := func(n NodeID, v Version, links ...NodeID) {
+		var state []LinkState
+		for _, l := range links {
+			state = append(state, LinkState{Node: l})
+		}
+		link.Incoming(c.ConnectivityPropagation(),
+			[]Update{{Node: n, Version: v, State: state}})
+	}
+
+	incoming("b", 1, "a", "c")
+	incoming("c", 1, "b")
+
+	// c drops its link to b, but b still reports it
+	incoming("c", 2)
+	require.Len(t, c.Members(), 2)
+
+	// Then b drops it too
+	incoming("b", 2, "a")
+
+	// And they are linked again
+	incoming("c", 3, "b")
+	incoming("b", 3, "a", "c")
+
+	require.Equal(t, []MembershipEvent{
+		{Seq: 1, Kind: NodeJoined, Node: "a"},
+		{Seq: 2, Kind: NodeJoined, Node: "b"},
+		{Seq: 3, Kind: NodeJoined, Node: "c"},
+		{Seq: 4, Kind: NodeUnreachable, Node: "c"},
+		{Seq: 5, Kind: NodeLeft, Node: "c"},
+		{Seq: 6, Kind: NodeJoined, Node: "c"},
+	}, seen)
+	require.Equal(t, uint64(6), c.MembershipSeq())
+
+	// Replay from the retained events
+	evs, err := c.MembershipEvents(5)
+	require.NoError(t, err)
+	require.Equal(t, seen[4:], evs)
+
+	evs, err = c.MembershipEvents(0)
+	require.NoError(t, err)
+	require.Equal(t, seen[2:], evs)
+
+	evs, err = c.MembershipEvents(7)
+	require.NoError(t, err)
+	require.Empty(t, evs)
+
+	_, err = c.MembershipEvents(2)
+	require.Error(t, err)
+
+	// Events that have not happened yet cannot be asked for
+	_, err = c.MembershipEvents(8)
+	require.Error(t, err)
+}
+
+func TestTreeInfo(t *testing.T) {
+	// A star, whose centre is the root
+	g := edgeGraph([]NodeID{"a", "b", "c", "d"},
+		[][2]NodeID{{"a", "b"}, {"a", "c"}, {"a", "d"}})
+
+	s := makeSim(g)
+	s.converge()
+
+	require.Equal(t, TreeInfo{
+		Root:     "a",
+		Children: []NodeID{"b", "c", "d"},
+		Links:    []NodeID{"b", "c", "d"},
+	}, s.cs["a"].TreeInfo())
+	require.Equal(t, TreeInfo{Root: "a", Parent: "a", Depth: 1,
+		Links: []NodeID{"a"}}, s.cs["b"].TreeInfo())
+
+	// Move b to hang off c
+	var changes []TreeInfo
+	s.cs["b"].SetTreeInfoFunc(func(ti TreeInfo) { changes = append(changes, ti) })
+	s.disconnect(graph.Edge{A: "a", B: "b"})
+	s.link(graph.Edge{A: "b", B: "c"})
+	s.converge()
+
+	ti := TreeInfo{Root: "a", Parent: "c", Depth: 2, Links: []NodeID{"c"}}
+	require.Equal(t, ti, s.cs["b"].TreeInfo())
+	require.Equal(t, ti, changes[len(changes)-1])
+	for i := 1; i < len(changes); i++ {
+		require.NotEqual(t, changes[i-1], changes[i])
+	}
+}
+
+func TestExports(t *testing.T) {
+	// A star, with a link between two of its leaves
+	g := edgeGraph([]NodeID{"a", "b", "c", "d"},
+		[][2]NodeID{{"a", "b"}, {"a", "c"}, {"a", "d"}, {"b", "c"}})
+
+	s := makeSim(g)
+	s.converge()
+
+	var buf bytes.Buffer
+	require.NoError(t, s.cs["b"].WriteDOT(&buf))
+	require.Equal(t, `graph {
+	"a" [shape=doublecircle];
+	"b";
+	"c";
+	"d";
+	"a" -- "b" [label="1000000", style=bold];
+	"a" -- "c" [label="1000000", style=bold];
+	"a" -- "d" [label="1000000", style=bold];
+	"b" -- "c" [label="1000000"];
+}
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, s.cs["b"].WriteJSON(&buf))
+	require.Equal(t, `{"root":"a","nodes":["a","b","c","d"],"edges":[`+
+		`{"from":"a","to":"b","weight":1000000,"tree":true},`+
+		`{"from":"a","to":"c","weight":1000000,"tree":true},`+
+		`{"from":"a","to":"d","weight":1000000,"tree":true},`+
+		`{"from":"b","to":"a","weight":1000000,"tree":true},`+
+		`{"from":"b","to":"c","weight":1000000},`+
+		`{"from":"c","to":"a","weight":1000000,"tree":true},`+
+		`{"from":"c","to":"b","weight":1000000},`+
+		`{"from":"d","to":"a","weight":1000000,"tree":true}]}
+`, buf.String())
+}
+
+func TestStableRoot(t *testing.T) {
+	// A path, with a spare node to extend it
+	g := edgeGraph([]NodeID{"a", "b", "c", "d", "e", "f", "g", "h"},
+		[][2]NodeID{{"a", "b"}, {"b", "c"}, {"c", "d"}, {"d", "e"},
+			{"e", "f"}, {"f", "g"}})
+
+	s := makeSim(g)
+	s.converge()
+
+	// The root is within the margin of the centre, d
+	root := s.cs["a"].TreeInfo().Root
+	require.Contains(t, []NodeID{"c", "d", "e"}, root)
+	require.Equal(t, NodeID("d"), s.cs["a"].SpanningTree().Root())
+
+	// Extending the path moves the centre, but not the root
+	s.link(graph.Edge{A: "h", B: "a"})
+	s.converge()
+
+	require.Equal(t, NodeID("c"), s.cs["a"].SpanningTree().Root())
+	for _, n := range g.Nodes {
+		require.Equal(t, root, s.cs[n].TreeInfo().Root)
+	}
+
+	// Nodes with different margins can choose different roots, so
+	// the margin is part of the policy name that nodes compare
+	p := DefaultConfig.TreePolicy.(BushyTreePolicy)
+	q := p
+	q.RootMargin++
+	require.NotEqual(t, p.Name(), q.Name())
+}
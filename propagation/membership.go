@@ -0,0 +1,172 @@
+package propagation
+
+import (
+	"fmt"
+
+	"github.com/dpw/monotreme/graph"
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+type MembershipEventKind int
+
+const (
+	// The node became a member of the cluster
+	NodeJoined MembershipEventKind = iota
+
+	// The node ceased to be a member, and no member reports a
+	// link to it
+	NodeLeft
+
+	// The node ceased to be a member, but some member still
+	// reports a link to it, so it might return.  If those links
+	// go too, a NodeLeft event follows.
+	NodeUnreachable
+)
+
+func (k MembershipEventKind) String() string {
+	switch k {
+	case NodeJoined:
+		return "joined"
+	case NodeLeft:
+		return "left"
+	case NodeUnreachable:
+		return "unreachable"
+	default:
+		return fmt.Sprintf("MembershipEventKind(%d)", int(k))
+	}
+}
+
+// A change to the membership of the cluster, as seen by this node.
+// Events are numbered consecutively from 1.
+type MembershipEvent struct {
+	Seq  uint64
+	Kind MembershipEventKind
+	Node NodeID
+}
+
+// The state of the membership as of the last computation of the
+// spanning tree, and the retained events.
+type membership struct {
+	// The shortest paths to the members: the same map as
+	// Connectivity.paths
+	members     map[NodeID]graph.ShortestPath
+	unreachable map[NodeID]struct{}
+
+	events  []MembershipEvent
+	lastSeq uint64
+	onEvent func(MembershipEvent)
+}
+
+// Call f for each membership event, as it happens.
+func (c *Connectivity) SetMembershipFunc(f func(MembershipEvent)) {
+	c.membership.onEvent = f
+}
+
+// The sequence number of the latest membership event, or zero if
+// there have been none
+func (c *Connectivity) MembershipSeq() uint64 {
+	return c.membership.lastSeq
+}
+
+// The retained membership events with sequence numbers from from
+// onwards, so that a consumer can catch up on the events it missed.
+// Up to Config.MembershipHistory events are retained.  It is an
+// error if events from from onwards have been discarded, unless from
+// is zero, which asks for all the retained events, or if from is
+// beyond the next event.
+func (c *Connectivity) MembershipEvents(from uint64) ([]MembershipEvent, error) {
+	m := &c.membership
+	first := m.lastSeq + 1 - uint64(len(m.events))
+	if from == 0 {
+		from = first
+	} else if from < first {
+		return nil, fmt.Errorf("membership events before %d have been discarded", first)
+	}
+
+	if from > m.lastSeq+1 {
+		return nil, fmt.Errorf("membership event %d is beyond the next event %d",
+			from, m.lastSeq+1)
+	}
+
+	if from > m.lastSeq {
+		return nil, nil
+	}
+
+	return append([]MembershipEvent(nil), m.events[from-first:]...), nil
+}
+
+// Compare the members with those in the new graph, and produce
+// events.  Called from recompute after pruning, once the graph is
+// set.
+func (c *Connectivity) updateMembership() {
+	m := &c.membership
+	members := c.shortestPaths()
+
+	// The nodes to which members report links
+	listed := make(map[NodeID]struct{})
+	for n := range members {
+		state, _ := c.connProp.Get(n, nil).([]LinkState)
+		for _, ls := range state {
+			listed[ls.Node] = struct{}{}
+		}
+	}
+
+	var joined, unreachable, left []NodeID
+	for n := range members {
+		if _, present := m.members[n]; !present {
+			joined = append(joined, n)
+			delete(m.unreachable, n)
+		}
+	}
+
+	for n := range m.members {
+		if _, present := members[n]; present {
+			continue
+		}
+
+		if _, present := listed[n]; present {
+			unreachable = append(unreachable, n)
+		} else {
+			left = append(left, n)
+		}
+	}
+
+	for n := range m.unreachable {
+		if _, present := listed[n]; !present {
+			left = append(left, n)
+			delete(m.unreachable, n)
+		}
+	}
+
+	m.members = members
+	for _, n := range graph.SortNodeIDs(joined) {
+		c.membershipEvent(NodeJoined, n)
+	}
+
+	for _, n := range graph.SortNodeIDs(unreachable) {
+		m.unreachable[n] = struct{}{}
+		c.membershipEvent(NodeUnreachable, n)
+	}
+
+	for _, n := range graph.SortNodeIDs(left) {
+		c.membershipEvent(NodeLeft, n)
+	}
+}
+
+func (c *Connectivity) membershipEvent(kind MembershipEventKind, n NodeID) {
+	m := &c.membership
+	m.lastSeq++
+	ev := MembershipEvent{Seq: m.lastSeq, Kind: kind, Node: n}
+
+	if limit := c.config.MembershipHistory; limit > 0 {
+		if len(m.events) >= limit {
+			m.events = append(m.events[:0], m.events[len(m.events)-limit+1:]...)
+		}
+
+		m.events = append(m.events, ev)
+	}
+
+	if m.onEvent != nil {
+		m.onEvent(ev)
+	}
+}
@@ -0,0 +1,175 @@
+package propagation
+
+import (
+	"fmt"
+
+	"github.com/dpw/monotreme/graph"
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+// A TreePolicy determines the spanning tree over which updates are
+// propagated.  The nodes of a cluster must agree about the tree, so
+// they must all use the same policy, and the tree must be a
+// deterministic function of the graph.
+type TreePolicy interface {
+	// The name of the policy, including any parameters that
+	// affect the tree.  Nodes exchange policy names when they
+	// connect, so that a mismatch can be detected.
+	Name() string
+
+	// Produce a spanning tree for the (symmetric) graph.  The
+	// edge weights of the graph are derived from link RTTs; a
+	// policy may ignore them.
+	BuildTree(g graph.Graph) graph.Tree
+
+	// Whether the tree depends on the edge weights.  If not,
+	// changes to link RTTs are not propagated.
+	Weighted() bool
+}
+
+// Strip the edge weights from a graph, for the policies that only
+// consider hop counts.
+func unweighted(g graph.Graph) graph.Graph {
+	g.Weight = nil
+	return g
+}
+
+// A TreePolicy that can also maintain a tree incrementally, changing
+// as few links as possible.  See Config.IncrementalTree.
+type IncrementalTreePolicy interface {
+	TreePolicy
+
+	// Produce a spanning tree for the graph, based on the
+	// previous tree given by parents, which maps nodes to their
+	// parents.  The previous tree comes from the connectivity
+	// states of the nodes, so it might be incomplete or contain
+	// cycles while they change.
+	UpdateTree(parents map[NodeID]NodeID, g graph.Graph) graph.Tree
+}
+
+// The bushy tree: rooted at a pseudo-central node, and with a soft
+// limit on the number of children of each node.  Edge weights are
+// ignored.
+type BushyTreePolicy struct {
+	// The number of witness nodes used to estimate the
+	// eccentricity of nodes when choosing the root
+	Witnesses int
+
+	// The number of children a node can have before other
+	// parents are sought for further nodes
+	SoftChildLimit int
+
+	// When the tree is maintained incrementally, its root is kept
+	// unless another node's pseudo-eccentricity is better by more
+	// than this.
+	RootMargin int
+}
+
+func (p BushyTreePolicy) Name() string {
+	return fmt.Sprintf("bushy(witnesses=%d,limit=%d,margin=%d)",
+		p.Witnesses, p.SoftChildLimit, p.RootMargin)
+}
+
+func (p BushyTreePolicy) BuildTree(g graph.Graph) graph.Tree {
+	g = unweighted(g)
+	root := graph.FindPseudoCentralNode(g, p.Witnesses)
+	return graph.MakeBushySpanningTree(g, root, p.SoftChildLimit)
+}
+
+func (p BushyTreePolicy) Weighted() bool {
+	return false
+}
+
+func (p BushyTreePolicy) UpdateTree(parents map[NodeID]NodeID, g graph.Graph) graph.Tree {
+	g = unweighted(g)
+	root, _ := graph.ForestRoot(parents)
+	root = graph.FindStablePseudoCentralNode(g, p.Witnesses, root,
+		p.RootMargin)
+	return graph.UpdateBushySpanningTree(parents, g, root,
+		p.SoftChildLimit)
+}
+
+// A breadth-first tree rooted at a pseudo-central node.  Edge weights
+// are ignored.
+type BFSTreePolicy struct {
+	Witnesses int
+}
+
+func (p BFSTreePolicy) Name() string {
+	return fmt.Sprintf("bfs(witnesses=%d)", p.Witnesses)
+}
+
+func (p BFSTreePolicy) BuildTree(g graph.Graph) graph.Tree {
+	g = unweighted(g)
+	return graph.MakeBFSTree(g,
+		graph.FindPseudoCentralNode(g, p.Witnesses))
+}
+
+func (p BFSTreePolicy) Weighted() bool {
+	return false
+}
+
+// A tree rooted at a pseudo-central node, in which the degree of
+// nodes is limited to MaxDegree where possible.  Edge weights are
+// ignored.
+type DegreeBoundedTreePolicy struct {
+	Witnesses int
+	MaxDegree int
+}
+
+func (p DegreeBoundedTreePolicy) Name() string {
+	return fmt.Sprintf("degree-bounded(witnesses=%d,max=%d)",
+		p.Witnesses, p.MaxDegree)
+}
+
+func (p DegreeBoundedTreePolicy) BuildTree(g graph.Graph) graph.Tree {
+	g = unweighted(g)
+	return graph.MakeDegreeBoundedSpanningTree(g,
+		graph.FindPseudoCentralNode(g, p.Witnesses), p.MaxDegree)
+}
+
+func (p DegreeBoundedTreePolicy) Weighted() bool {
+	return false
+}
+
+// A minimum spanning tree of the weighted graph, rooted at a
+// pseudo-central node
+type MinimumSpanningTreePolicy struct {
+	Witnesses int
+}
+
+func (p MinimumSpanningTreePolicy) Name() string {
+	return fmt.Sprintf("mst(witnesses=%d)", p.Witnesses)
+}
+
+func (p MinimumSpanningTreePolicy) BuildTree(g graph.Graph) graph.Tree {
+	return graph.MakeMinimumSpanningTree(g,
+		graph.FindPseudoCentralNode(g, p.Witnesses))
+}
+
+func (p MinimumSpanningTreePolicy) Weighted() bool {
+	return true
+}
+
+// A tree that minimises the weighted distance of nodes from the root,
+// subject to a soft limit on the number of children of each node.
+// The root is the pseudo-central node with respect to the weighted
+// distance.
+type WeightedTreePolicy struct {
+	Witnesses      int
+	SoftChildLimit int
+}
+
+func (p WeightedTreePolicy) Name() string {
+	return fmt.Sprintf("weighted(witnesses=%d,limit=%d)",
+		p.Witnesses, p.SoftChildLimit)
+}
+
+func (p WeightedTreePolicy) BuildTree(g graph.Graph) graph.Tree {
+	return graph.MakeWeightedSpanningTree(g,
+		graph.FindPseudoCentralNode(g, p.Witnesses), p.SoftChildLimit)
+}
+
+func (p WeightedTreePolicy) Weighted() bool {
+	return true
+}
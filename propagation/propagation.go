@@ -22,6 +22,9 @@ type nodeState struct {
 
 	// Records to which neighbors this state has been delivered.
 	delivered bitset.BitSet
+
+	// For a retained state, the prune call that removed it
+	prunedAt uint64
 }
 
 type Neighbor struct {
@@ -39,12 +42,22 @@ type Propagation struct {
 	neighbors []*Neighbor
 	nodes     map[NodeID]*nodeState
 	onChange  func()
+
+	// States removed by prune, retained in case the node becomes
+	// reachable again, for retainPrunes calls to prune.  See
+	// prune.
+	pruned       map[NodeID]*nodeState
+	prunes       uint64
+	retainPrunes uint64
 }
 
 func newPropagation(onChange func()) *Propagation {
 	return &Propagation{
 		nodes:    make(map[NodeID]*nodeState),
 		onChange: onChange,
+		pruned:   make(map[NodeID]*nodeState),
+
+		retainPrunes: uint64(DefaultConfig.PrunedStateRetention),
 	}
 }
 
@@ -56,6 +69,15 @@ func (p *Propagation) Get(node NodeID, def interface{}) interface{} {
 	return def
 }
 
+// Like Get, but also returns retained states of pruned nodes.
+func (p *Propagation) getRetained(node NodeID, def interface{}) interface{} {
+	if ns := p.pruned[node]; ns != nil {
+		return ns.State
+	}
+
+	return p.Get(node, def)
+}
+
 func (p *Propagation) AddNeighbor() *Neighbor {
 	n := &Neighbor{Propagation: p, index: uint(len(p.neighbors))}
 	p.neighbors = append(p.neighbors, n)
@@ -119,13 +141,35 @@ func (p *Propagation) addNodeState(u Update) *nodeState {
 	return ns
 }
 
+// Remove the states of nodes that are not in the graph g.
+//
+// Our neighbors don't know that we dropped a state, and won't send it
+// again unless it changes.  So if a pruned node returns to g with its
+// state unchanged, the state must come from somewhere else: Pruned
+// states are retained, and restored if their nodes reappear in g.
+// Nodes that have gone for good, such as restarted nodes with new
+// IDs, would make the retained states grow without bound, so they
+// are discarded after retainPrunes calls.  A node that returns after
+// that is usually in a new state anyway.
 func (p *Propagation) prune(g graph.Graph) {
+	p.prunes++
+	for node, ns := range p.pruned {
+		if g.Edges(node) != nil {
+			delete(p.pruned, node)
+			p.addNodeState(ns.Update)
+		} else if p.prunes-ns.prunedAt > p.retainPrunes {
+			delete(p.pruned, node)
+		}
+	}
+
 	var removed []*nodeState
 
 	for node, ns := range p.nodes {
 		if g.Edges(node) == nil {
 			delete(p.nodes, node)
 			removed = append(removed, ns)
+			ns.prunedAt = p.prunes
+			p.pruned[node] = ns
 		}
 	}
 
@@ -151,7 +195,13 @@ func (n *Neighbor) setDelivered(ns *nodeState) {
 func (p *Propagation) Set(n NodeID, state interface{}) {
 	ns := p.nodes[n]
 	if ns == nil {
-		p.addNodeState(Update{n, 0, state})
+		version := Version(0)
+		if pns := p.pruned[n]; pns != nil {
+			version = pns.Version + 1
+			delete(p.pruned, n)
+		}
+
+		p.addNodeState(Update{n, version, state})
 	} else {
 		ns.Version++
 		ns.State = state
@@ -168,6 +218,14 @@ func (n *Neighbor) Incoming(updates []Update) {
 
 	for _, u := range updates {
 		ns := n.nodes[u.Node]
+		if pns := n.pruned[u.Node]; pns != nil {
+			if pns.Version >= u.Version {
+				continue
+			}
+
+			delete(n.pruned, u.Node)
+		}
+
 		if ns == nil {
 			ns = n.addNodeState(u)
 		} else if ns.Version >= u.Version {
@@ -188,16 +246,32 @@ func (n *Neighbor) Incoming(updates []Update) {
 
 // Get the updates pending for the neighbor
 func (n *Neighbor) Outgoing() []Update {
+	return n.outgoing(0)
+}
+
+// Get at most max of the updates pending for the neighbor, or all of
+// them if max is not positive.
+func (n *Neighbor) outgoing(max int) []Update {
 	n.activate()
 	var res []Update
 
 	for ns := range n.undelivered {
+		if max > 0 && len(res) == max {
+			break
+		}
+
 		res = append(res, ns.Update)
 	}
 
 	return res
 }
 
+// The number of updates pending for the neighbor
+func (n *Neighbor) Backlog() int {
+	n.activate()
+	return len(n.undelivered)
+}
+
 // Are there pending updates for the neighbor?
 func (n *Neighbor) HasOutgoing() bool {
 	n.activate()
@@ -0,0 +1,275 @@
+package sim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dpw/monotreme/graph"
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+// A Scenario is a sequence of changes to a simulation, at given
+// times.  It is written as a script with one step per line, e.g.
+//
+//	# comments start with '#'
+//	at 5s cut 0-1
+//	at 6s link 0-2
+//	at t=10s add 50 nodes with 3 links
+//	at 15s remove node 7
+//	at 20s partition 0 1 2 / 3 4
+//	at 25s heal
+//
+// "cut" and "link" remove and add the link between two nodes.  "add"
+// adds nodes, each linked to some (by default 2) random existing
+// nodes; the new nodes are numbered after the existing ones.
+// "remove" removes a node and its links.  "partition" cuts the links
+// between groups of nodes separated by "/", as Sim.Partition, and
+// "heal" restores them.  The steps must be in time order.
+type Scenario []Step
+
+type Step struct {
+	At time.Duration
+
+	// The text of the step, e.g. "cut 0-1"
+	Action string
+
+	line  int
+	apply func(s *Sim) error
+}
+
+// The metrics of the period from a step until the next step (or until
+// the simulation became quiescent, for the last step)
+type Result struct {
+	Step
+	Metrics Metrics
+}
+
+// Parse a scenario script
+func ParseScenario(r io.Reader) (Scenario, error) {
+	var sc Scenario
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		step, err := parseStep(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		if len(sc) > 0 && step.At < sc[len(sc)-1].At {
+			return nil, fmt.Errorf("line %d: step at %v is before the previous step", line, step.At)
+		}
+
+		step.line = line
+		sc = append(sc, step)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return sc, nil
+}
+
+func parseStep(text string) (Step, error) {
+	fields := strings.Fields(text)
+	if len(fields) < 3 || fields[0] != "at" {
+		return Step{}, fmt.Errorf("expected \"at <time> <action>\"")
+	}
+
+	at, err := time.ParseDuration(strings.TrimPrefix(fields[1], "t="))
+	if err != nil {
+		return Step{}, err
+	}
+
+	step := Step{At: at, Action: strings.Join(fields[2:], " ")}
+	args := fields[3:]
+	optional := func(word string) {
+		if len(args) > 0 && args[0] == word {
+			args = args[1:]
+		}
+	}
+
+	switch fields[2] {
+	case "cut", "link":
+		optional("edge")
+		optional("link")
+		if len(args) != 1 {
+			return Step{}, fmt.Errorf("expected a link A-B")
+		}
+
+		a, b, found := strings.Cut(args[0], "-")
+		if !found || a == "" || b == "" {
+			return Step{}, fmt.Errorf("expected a link A-B, got %q", args[0])
+		}
+
+		e := graph.Edge{A: NodeID(a), B: NodeID(b)}
+		cut := fields[2] == "cut"
+		step.apply = func(s *Sim) error {
+			if err := s.checkNodes(e.A, e.B); err != nil {
+				return err
+			}
+
+			linked := s.topology.Contains(e)
+			switch {
+			case cut && !linked:
+				return fmt.Errorf("no link %s-%s", e.A, e.B)
+			case !cut && linked:
+				return fmt.Errorf("already a link %s-%s", e.A, e.B)
+			case cut:
+				s.CutLink(e)
+			default:
+				s.AddLink(e)
+			}
+			return nil
+		}
+
+	case "add":
+		usage := fmt.Errorf("expected \"add <n> nodes [with <k> links]\"")
+		if len(args) < 2 || (args[1] != "nodes" && args[1] != "node") {
+			return Step{}, usage
+		}
+
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return Step{}, err
+		}
+
+		if n < 0 {
+			return Step{}, fmt.Errorf("negative number of nodes %d", n)
+		}
+
+		k := 2
+		switch {
+		case len(args) == 2:
+		case len(args) == 5 && args[2] == "with" &&
+			(args[4] == "links" || args[4] == "link"):
+			if k, err = strconv.Atoi(args[3]); err != nil {
+				return Step{}, err
+			}
+
+			if k < 0 {
+				return Step{}, fmt.Errorf("negative number of links %d", k)
+			}
+		default:
+			return Step{}, usage
+		}
+
+		step.apply = func(s *Sim) error {
+			s.addNodes(n, k)
+			return nil
+		}
+
+	case "remove":
+		optional("node")
+		if len(args) != 1 {
+			return Step{}, fmt.Errorf("expected a node")
+		}
+
+		id := NodeID(args[0])
+		step.apply = func(s *Sim) error {
+			if err := s.checkNodes(id); err != nil {
+				return err
+			}
+
+			s.RemoveNode(id)
+			return nil
+		}
+
+	case "partition":
+		groups := [][]NodeID{nil}
+		for _, arg := range args {
+			if arg == "/" {
+				groups = append(groups, nil)
+				continue
+			}
+
+			last := len(groups) - 1
+			groups[last] = append(groups[last], NodeID(arg))
+		}
+
+		step.apply = func(s *Sim) error {
+			for _, g := range groups {
+				if err := s.checkNodes(g...); err != nil {
+					return err
+				}
+			}
+
+			s.Partition(groups...)
+			return nil
+		}
+
+	case "heal":
+		if len(args) != 0 {
+			return Step{}, fmt.Errorf("unexpected arguments to heal")
+		}
+
+		step.apply = func(s *Sim) error {
+			s.Heal()
+			return nil
+		}
+
+	default:
+		return Step{}, fmt.Errorf("unknown action %q", fields[2])
+	}
+
+	return step, nil
+}
+
+func (s *Sim) checkNodes(ids ...NodeID) error {
+	for _, id := range ids {
+		if s.nodes[id] == nil {
+			return fmt.Errorf("no node %s", id)
+		}
+	}
+
+	return nil
+}
+
+// Add n nodes, each linked to k random existing nodes
+func (s *Sim) addNodes(n, k int) {
+	next := len(s.nodes)
+	for ; n > 0; n-- {
+		for s.nodes[NodeID(strconv.Itoa(next))] != nil {
+			next++
+		}
+
+		existing := s.Nodes()
+		id := NodeID(strconv.Itoa(next))
+		s.AddNode(id)
+
+		for _, i := range s.rng.Perm(len(existing))[:min(k, len(existing))] {
+			s.AddLink(graph.Edge{A: id, B: existing[i]})
+		}
+	}
+}
+
+// Run the scenario on a simulation, from its current time.  The first
+// result, with the Action "start", covers the period before the first
+// step.  The last covers the period until the simulation became
+// quiescent.
+func (sc Scenario) Run(s *Sim) ([]Result, error) {
+	var res []Result
+	current := Result{Step: Step{At: s.Now(), Action: "start"}}
+	for _, step := range sc {
+		s.RunUntil(step.At)
+		current.Metrics = s.takeMetrics()
+		res = append(res, current)
+
+		if err := step.apply(s); err != nil {
+			return res, fmt.Errorf("line %d: %s", step.line, err)
+		}
+
+		current = Result{Step: step}
+	}
+
+	current.Metrics = s.Run()
+	return append(res, current), nil
+}
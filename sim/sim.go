@@ -0,0 +1,661 @@
+// Package sim is a discrete-event simulator for the connectivity
+// propagation protocol.  It drives real propagation.Connectivity
+// instances over simulated links with latency, bandwidth limits, loss
+// and partitions, in virtual time, and measures how the protocol
+// responds to topology changes.  A simulation is deterministic given
+// its seed.
+//
+// Each simulated node computes its own spanning trees, as a real node
+// would, so the cost of a simulation grows faster than the square of
+// the number of nodes.  A few hundred nodes take seconds, but a
+// thousand take over a minute, and that is about the practical limit.
+package sim
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/dpw/monotreme/graph"
+	"github.com/dpw/monotreme/propagation"
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+// The characteristics of a link, applying to each direction
+// separately
+type LinkParams struct {
+	// The one-way delay of a message
+	Latency time.Duration
+
+	// The rate at which messages are sent, in bytes per second.
+	// Zero means unlimited.
+	Bandwidth int
+
+	// The probability that a transmission of a message is lost.
+	// Links are reliable, like TCP connections, so a lost
+	// message is retransmitted after Config.RetransmitTimeout,
+	// and later messages are held up behind it.  Must be less
+	// than 1.
+	Loss float64
+}
+
+// Parameters of a simulation
+type Config struct {
+	// The parameters of links, unless overridden with
+	// SetLinkParams
+	Link LinkParams
+
+	// The maximum number of updates in a message.  Zero means
+	// unlimited.
+	MaxBatchUpdates int
+
+	// How long to wait after a connectivity change before
+	// recomputing the spanning tree.  Zero means recompute
+	// immediately.
+	RecomputeDelay time.Duration
+
+	// The size in bytes of a message carrying the given updates,
+	// which determines its transmission time and the byte
+	// counts.  If nil, the size is estimated from the lengths of
+	// the node IDs.
+	MessageSize func(updates []propagation.Update) int
+
+	// The delay before a lost message is retransmitted
+	RetransmitTimeout time.Duration
+
+	// The seed for the random choices of the simulation
+	Seed int64
+
+	Connectivity propagation.Config
+}
+
+var DefaultConfig = Config{
+	Link:              LinkParams{Latency: time.Millisecond},
+	RetransmitTimeout: 200 * time.Millisecond,
+	Connectivity:      propagation.DefaultConfig,
+}
+
+// Measurements of a simulation over a period.  See Sim.Run.
+type Metrics struct {
+	// The number of topology changes made during the period
+	Changes int
+
+	// The time from the first topology change in the period to
+	// the last delivery of a message
+	ConvergenceTime time.Duration
+
+	// The messages sent, their total size in bytes, and the
+	// number of retransmissions of lost messages.  Bytes include
+	// retransmissions.
+	Messages        int
+	Bytes           int
+	Retransmissions int
+
+	// The number of spanning tree computations, and the number
+	// of links added to or removed from the spanning tree by
+	// them, summed over all nodes
+	Recomputations int
+	TreeChurn      int
+
+	// Whether the nodes of each connected component agree about
+	// the connectivity of the cluster at the end of the period
+	Converged bool
+}
+
+// A Sim is a simulated cluster.  It is not safe for concurrent use.
+type Sim struct {
+	config Config
+	rng    *rand.Rand
+	now    time.Duration
+	events eventHeap
+	seq    uint64
+
+	// The nodes and the links between them, whether or not the
+	// links are cut by a partition
+	topology graph.Undirected
+
+	nodes  map[NodeID]*node
+	links  map[graph.Edge]*link
+	params map[graph.Edge]LinkParams
+
+	// The spanning trees and graphs computed by the nodes
+	trees  *sharedTrees
+	graphs *sharedGraphs
+
+	// The partition group of each node, or nil if there is no
+	// partition
+	partition map[NodeID]int
+
+	// Links woken since the last event
+	woken []*direction
+
+	metrics       Metrics
+	firstChange   time.Duration
+	lastDelivery  time.Duration
+	changePending bool
+}
+
+type node struct {
+	id     NodeID
+	c      *propagation.Connectivity
+	policy *nodeTreePolicy
+
+	// The tree over which the node propagates updates, and its
+	// generation in the shared trees
+	tree           graph.Tree
+	treeGeneration uint64
+
+	// The recomputations of c accounted for in the metrics
+	recomputations int
+}
+
+type link struct {
+	edge graph.Edge
+	dirs [2]*direction
+}
+
+// One direction of a link
+type direction struct {
+	sim              *Sim
+	edge             graph.Edge
+	from, to         *node
+	sender, receiver *propagation.Link
+	closed           bool
+
+	// Whether a send is scheduled or in progress
+	busy bool
+
+	// The arrival time of the last message, so that messages
+	// arrive in order
+	lastArrival time.Duration
+}
+
+// Create a simulation of the nodes and links of g.  The links are
+// established at time zero, so the first call to Run measures the
+// initial convergence of the cluster.
+func New(g graph.Undirected, config Config) *Sim {
+	if config.Connectivity.TreePolicy == nil {
+		config.Connectivity.TreePolicy = propagation.DefaultConfig.TreePolicy
+	}
+
+	s := &Sim{
+		config: config,
+		trees:  newSharedTrees(config.Connectivity.TreePolicy),
+		graphs: newSharedGraphs(),
+		rng:    rand.New(rand.NewSource(config.Seed)),
+		topology: graph.Undirected{
+			Edges: make(map[graph.Edge]struct{}),
+		},
+		nodes:  make(map[NodeID]*node),
+		links:  make(map[graph.Edge]*link),
+		params: make(map[graph.Edge]LinkParams),
+	}
+
+	checkLinkParams(config.Link)
+	for _, n := range g.Nodes {
+		s.AddNode(n)
+	}
+
+	for _, e := range g.SortedEdges() {
+		s.AddLink(e)
+	}
+
+	return s
+}
+
+func checkLinkParams(p LinkParams) {
+	if p.Loss < 0 || p.Loss >= 1 {
+		panic(fmt.Sprintf("link loss probability %v out of range", p.Loss))
+	}
+}
+
+// The current virtual time
+func (s *Sim) Now() time.Duration {
+	return s.now
+}
+
+// The nodes of the simulation
+func (s *Sim) Nodes() []NodeID {
+	return graph.SortNodeIDs(s.topology.Nodes)
+}
+
+// The links of the simulation, including those cut by a partition
+func (s *Sim) Topology() graph.Undirected {
+	return s.topology
+}
+
+// The Connectivity of a node, or nil if there is no such node
+func (s *Sim) Connectivity(n NodeID) *propagation.Connectivity {
+	if nd := s.nodes[n]; nd != nil {
+		return nd.c
+	}
+
+	return nil
+}
+
+// Schedule f to be called at time t, or now if t has passed.  f may
+// change the topology.
+func (s *Sim) At(t time.Duration, f func()) {
+	if t < s.now {
+		t = s.now
+	}
+
+	s.seq++
+	heap.Push(&s.events, event{at: t, seq: s.seq, f: f})
+}
+
+// Process events until the simulation is quiescent, i.e. there are
+// no messages in flight and no scheduled events, and return the
+// metrics since the previous call to Run.  Run does not return if
+// the protocol never settles.
+func (s *Sim) Run() Metrics {
+	s.flushWoken()
+	for s.events.Len() > 0 {
+		s.step()
+	}
+
+	return s.takeMetrics()
+}
+
+// Process the events up to time t, and advance the time to t.  The
+// metrics accumulate until the next call to Run.
+func (s *Sim) RunUntil(t time.Duration) {
+	s.flushWoken()
+	for s.events.Len() > 0 && s.events[0].at <= t {
+		s.step()
+	}
+
+	if t > s.now {
+		s.now = t
+	}
+}
+
+func (s *Sim) step() {
+	e := heap.Pop(&s.events).(event)
+	s.now = e.at
+	e.f()
+	s.flushWoken()
+}
+
+func (s *Sim) takeMetrics() Metrics {
+	m := s.metrics
+	if s.changePending && s.lastDelivery > s.firstChange {
+		m.ConvergenceTime = s.lastDelivery - s.firstChange
+	}
+
+	m.Converged = s.Converged()
+	s.metrics = Metrics{}
+	s.changePending = false
+	return m
+}
+
+func (s *Sim) changed() {
+	s.metrics.Changes++
+	if !s.changePending {
+		s.changePending = true
+		s.firstChange = s.now
+	}
+}
+
+// Add a node, without links
+func (s *Sim) AddNode(id NodeID) {
+	if s.nodes[id] != nil {
+		panic("duplicate node " + string(id))
+	}
+
+	config := s.config.Connectivity
+	n := &node{id: id}
+	config.TreePolicy, n.policy = s.trees.nodePolicy()
+	config.ShareGraph = s.graphs.share
+	n.c = propagation.NewConnectivityWithConfig(id, config)
+	s.nodes[id] = n
+	s.topology.Nodes = append(s.topology.Nodes, id)
+
+	if delay := s.config.RecomputeDelay; delay > 0 {
+		n.c.SetDeferRecompute(func() {
+			s.At(s.now+delay, func() {
+				if s.nodes[id] == n {
+					n.c.Recompute()
+					s.checkTree(n)
+				}
+			})
+		})
+	}
+
+	s.checkTree(n)
+	s.changed()
+}
+
+// Remove a node and its links, as if it crashed
+func (s *Sim) RemoveNode(id NodeID) {
+	if s.nodes[id] == nil {
+		return
+	}
+
+	for _, m := range s.topology.Nodes {
+		s.topology.Remove(graph.Edge{A: id, B: m})
+		s.update(graph.Edge{A: id, B: m}.Canonical())
+	}
+
+	delete(s.nodes, id)
+	for i, m := range s.topology.Nodes {
+		if m == id {
+			s.topology.Nodes = append(s.topology.Nodes[:i:i],
+				s.topology.Nodes[i+1:]...)
+			break
+		}
+	}
+
+	s.changed()
+}
+
+// Add a link between two nodes
+func (s *Sim) AddLink(e graph.Edge) {
+	if s.nodes[e.A] == nil || s.nodes[e.B] == nil {
+		panic(fmt.Sprintf("link %s-%s between unknown nodes", e.A, e.B))
+	}
+
+	s.topology.Add(e)
+	s.update(e.Canonical())
+	s.changed()
+}
+
+// Remove a link between two nodes
+func (s *Sim) CutLink(e graph.Edge) {
+	s.topology.Remove(e)
+	s.update(e.Canonical())
+	s.changed()
+}
+
+// Set the parameters of a link, overriding Config.Link.  They apply
+// to messages sent afterwards.
+func (s *Sim) SetLinkParams(e graph.Edge, p LinkParams) {
+	checkLinkParams(p)
+	s.params[e.Canonical()] = p
+}
+
+func (s *Sim) linkParams(e graph.Edge) LinkParams {
+	if p, present := s.params[e]; present {
+		return p
+	}
+
+	return s.config.Link
+}
+
+// Partition the network into groups of nodes, cutting the links
+// between groups.  Nodes not in any of the groups form one further
+// group.  This replaces any previous partition.
+func (s *Sim) Partition(groups ...[]NodeID) {
+	s.partition = make(map[NodeID]int)
+	for i, g := range groups {
+		for _, n := range g {
+			s.partition[n] = i + 1
+		}
+	}
+
+	s.updateAll()
+	s.changed()
+}
+
+// Remove any partition, restoring the links it cut
+func (s *Sim) Heal() {
+	s.partition = nil
+	s.updateAll()
+	s.changed()
+}
+
+func (s *Sim) updateAll() {
+	for _, e := range s.topology.SortedEdges() {
+		s.update(e)
+	}
+}
+
+// Establish or close the link for the canonical edge e, according to
+// the topology and partition
+func (s *Sim) update(e graph.Edge) {
+	want := !e.Reflexive() && s.topology.Contains(e) &&
+		s.nodes[e.A] != nil && s.nodes[e.B] != nil &&
+		s.partition[e.A] == s.partition[e.B]
+
+	l := s.links[e]
+	if want && l == nil {
+		s.openLink(e)
+	} else if !want && l != nil {
+		s.closeLink(l)
+	}
+}
+
+func (s *Sim) openLink(e graph.Edge) {
+	a := s.nodes[e.A]
+	b := s.nodes[e.B]
+	l := &link{edge: e}
+	s.links[e] = l
+
+	la := a.c.Link(b.id)
+	lb := b.c.Link(a.id)
+	l.dirs[0] = &direction{sim: s, edge: e, from: a, to: b, sender: la, receiver: lb}
+	l.dirs[1] = &direction{sim: s, edge: e, from: b, to: a, sender: lb, receiver: la}
+	la.SetPendingFunc(l.dirs[0].wake)
+	lb.SetPendingFunc(l.dirs[1].wake)
+	s.checkTree(a)
+	s.checkTree(b)
+
+	// Each end learns the RTT of the link after a round trip
+	s.At(s.now+2*s.linkParams(e).Latency, func() {
+		if s.links[e] != l {
+			return
+		}
+
+		rtt := 2 * s.linkParams(e).Latency
+		la.SetRTT(rtt)
+		lb.SetRTT(rtt)
+		s.checkTree(a)
+		s.checkTree(b)
+	})
+}
+
+func (s *Sim) closeLink(l *link) {
+	delete(s.links, l.edge)
+	for _, d := range l.dirs {
+		d.closed = true
+		d.sender.Close()
+		s.checkTree(d.from)
+	}
+}
+
+// Called by the sending Link when it has updates to send.  The
+// Connectivity wakes links in an arbitrary order, so the sends are
+// scheduled by flushWoken.
+func (d *direction) wake() {
+	if !d.busy && !d.closed {
+		d.busy = true
+		d.sim.woken = append(d.sim.woken, d)
+	}
+}
+
+func (s *Sim) flushWoken() {
+	sort.Slice(s.woken, func(i, j int) bool {
+		a, b := s.woken[i], s.woken[j]
+		return a.from.id < b.from.id ||
+			(a.from.id == b.from.id && a.to.id < b.to.id)
+	})
+
+	for _, d := range s.woken {
+		s.At(s.now, d.send)
+	}
+	s.woken = s.woken[:0]
+}
+
+func (d *direction) send() {
+	s := d.sim
+	if d.closed {
+		return
+	}
+
+	// The order of the outgoing updates is arbitrary, so sort
+	// them to keep the simulation deterministic
+	prop := d.from.c.ConnectivityPropagation()
+	all := d.sender.Outgoing()[prop]
+	if len(all) == 0 {
+		d.busy = false
+		return
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Node < all[j].Node
+	})
+	if max := s.config.MaxBatchUpdates; max > 0 && len(all) > max {
+		all = all[:max]
+	}
+
+	d.sender.Delivered(prop, all)
+
+	p := s.linkParams(d.edge)
+	size := estimateMessageSize(all)
+	if s.config.MessageSize != nil {
+		size = s.config.MessageSize(all)
+	}
+	var transmit time.Duration
+	if p.Bandwidth > 0 {
+		transmit = time.Duration(int64(size) * int64(time.Second) / int64(p.Bandwidth))
+	}
+
+	s.metrics.Messages++
+	s.metrics.Bytes += size
+	arrival := s.now + transmit + p.Latency
+	for s.rng.Float64() < p.Loss {
+		s.metrics.Retransmissions++
+		s.metrics.Bytes += size
+		arrival += s.config.RetransmitTimeout + transmit
+	}
+
+	if arrival < d.lastArrival {
+		arrival = d.lastArrival
+	}
+	d.lastArrival = arrival
+
+	s.At(arrival, func() {
+		if d.closed {
+			return
+		}
+
+		s.lastDelivery = s.now
+		d.receiver.Incoming(d.to.c.ConnectivityPropagation(), all)
+		s.checkTree(d.to)
+	})
+
+	// Send the next message once this one has been transmitted
+	s.At(s.now+transmit, d.send)
+}
+
+// Account for any recomputations of a node's spanning tree
+func (s *Sim) checkTree(n *node) {
+	r := n.c.Recomputations()
+	if r == n.recomputations {
+		return
+	}
+
+	s.metrics.Recomputations += r - n.recomputations
+	n.recomputations = r
+
+	// Nodes often get back the tree they already had, as the
+	// trees are shared
+	if g := n.policy.propagationGeneration(); g != n.treeGeneration {
+		t := n.c.PropagationTree()
+		d := n.tree.Diff(t)
+		s.metrics.TreeChurn += len(d.AddedLinks) + len(d.RemovedLinks)
+		n.tree = t
+		n.treeGeneration = g
+	}
+}
+
+// Whether the nodes of each connected component of the network, as
+// currently linked, agree about the connectivity of the cluster.
+func (s *Sim) Converged() bool {
+	adj := make(map[NodeID][]NodeID)
+	for e := range s.links {
+		adj[e.A] = append(adj[e.A], e.B)
+		adj[e.B] = append(adj[e.B], e.A)
+	}
+
+	seen := make(map[NodeID]bool)
+	for _, id := range s.Nodes() {
+		if seen[id] {
+			continue
+		}
+
+		var expect map[NodeID]interface{}
+		todo := []NodeID{id}
+		seen[id] = true
+		for len(todo) > 0 {
+			n := todo[0]
+			todo = todo[1:]
+
+			dump := s.nodes[n].c.Dump()
+			if expect == nil {
+				expect = dump
+			} else if !reflect.DeepEqual(expect, dump) {
+				return false
+			}
+
+			for _, m := range adj[n] {
+				if !seen[m] {
+					seen[m] = true
+					todo = append(todo, m)
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+type event struct {
+	at  time.Duration
+	seq uint64
+	f   func()
+}
+
+// Events are ordered by time, and then by the order in which they
+// were scheduled, so that simulations are deterministic
+type eventHeap []event
+
+func (h eventHeap) Len() int { return len(h) }
+
+func (h eventHeap) Less(i, j int) bool {
+	if h[i].at != h[j].at {
+		return h[i].at < h[j].at
+	}
+
+	return h[i].seq < h[j].seq
+}
+
+func (h eventHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *eventHeap) Push(x interface{}) {
+	*h = append(*h, x.(event))
+}
+
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Estimate the size of a message carrying the given updates: each
+// node ID, and eight bytes for each version and RTT
+func estimateMessageSize(updates []propagation.Update) int {
+	size := 0
+	for _, u := range updates {
+		size += len(u.Node) + 8
+		for _, ls := range u.State.([]propagation.LinkState) {
+			size += len(ls.Node) + 8
+		}
+	}
+
+	return size
+}
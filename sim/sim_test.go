@@ -0,0 +1,213 @@
+package sim
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dpw/monotreme/graph"
+	"github.com/dpw/monotreme/graph/gen"
+	"github.com/dpw/monotreme/propagation"
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+func TestSim(t *testing.T) {
+	g := gen.RandomConnected(1, 30, 15)
+	s := New(g, DefaultConfig)
+	m := s.Run()
+	require.True(t, m.Converged)
+	require.True(t, m.Messages > 0)
+	require.True(t, m.Bytes > m.Messages)
+	require.True(t, m.ConvergenceTime >= time.Millisecond)
+	require.True(t, m.TreeChurn > 0)
+	require.Len(t, s.Connectivity("0").Dump(), 30)
+
+	// Cut a link that is not a bridge
+	bridges := graph.Bridges(g.Graph())
+	var cut graph.Edge
+	for _, e := range g.SortedEdges() {
+		isBridge := false
+		for _, b := range bridges {
+			isBridge = isBridge || b == e
+		}
+
+		if !isBridge {
+			cut = e
+			break
+		}
+	}
+
+	s.CutLink(cut)
+	m = s.Run()
+	require.True(t, m.Converged)
+	require.Equal(t, 1, m.Changes)
+	require.True(t, m.Messages > 0)
+	require.NotContains(t, s.Connectivity(cut.A).Graph().Edges(cut.A), cut.B)
+
+	// Simulations are deterministic
+	run := func() Metrics {
+		config := DefaultConfig
+		config.Link.Loss = 0.1
+		config.Seed = 42
+		s := New(g, config)
+		s.Run()
+		s.CutLink(cut)
+		return s.Run()
+	}
+	require.Equal(t, run(), run())
+}
+
+func TestLinkParams(t *testing.T) {
+	g := gen.Ring(10)
+	config := DefaultConfig
+	config.Link.Latency = 10 * time.Millisecond
+	fast := New(g, config).Run()
+	require.True(t, fast.Converged)
+	require.True(t, fast.ConvergenceTime >= 50*time.Millisecond)
+
+	config.Link.Bandwidth = 1000
+	slow := New(g, config).Run()
+	require.True(t, slow.Converged)
+	require.True(t, slow.ConvergenceTime > fast.ConvergenceTime)
+
+	config.Link.Bandwidth = 0
+	config.Link.Loss = 0.3
+	lossy := New(g, config).Run()
+	require.True(t, lossy.Converged)
+	require.True(t, lossy.Retransmissions > 0)
+	require.True(t, lossy.ConvergenceTime > fast.ConvergenceTime)
+
+	s := New(g, DefaultConfig)
+	s.SetLinkParams(graph.Edge{A: "0", B: "1"}, LinkParams{Latency: time.Second})
+	require.True(t, s.Run().ConvergenceTime >= time.Second)
+}
+
+func TestPartition(t *testing.T) {
+	s := New(gen.Grid(4, 4), DefaultConfig)
+	s.Run()
+
+	var left []NodeID
+	for _, n := range s.Nodes() {
+		if n < "8" && len(n) == 1 {
+			left = append(left, n)
+		}
+	}
+
+	// Nodes 0-7 are the top two rows of the grid
+	s.Partition(left)
+	m := s.Run()
+	require.True(t, m.Converged)
+	require.Len(t, s.Connectivity("0").Dump(), 8)
+	require.Len(t, s.Connectivity("15").Dump(), 8)
+
+	s.Heal()
+	m = s.Run()
+	require.True(t, m.Converged)
+	require.Len(t, s.Connectivity("0").Dump(), 16)
+
+	s.RemoveNode("5")
+	s.AddNode("new")
+	s.AddLink(graph.Edge{A: "new", B: "0"})
+	m = s.Run()
+	require.True(t, m.Converged)
+	require.Equal(t, 3, m.Changes)
+	require.Len(t, s.Connectivity("15").Dump(), 16)
+	require.Nil(t, s.Connectivity("5"))
+}
+
+func TestScenario(t *testing.T) {
+	sc, err := ParseScenario(strings.NewReader(`
+# A comment
+at 100ms cut 0-1
+at t=200ms add 3 nodes with 2 links
+at 300ms remove node 5
+at 400ms partition 0 1 2 / 3
+at 500ms heal
+`))
+	require.NoError(t, err)
+	require.Len(t, sc, 5)
+	require.Equal(t, 200*time.Millisecond, sc[1].At)
+	require.Equal(t, "add 3 nodes with 2 links", sc[1].Action)
+
+	s := New(gen.Ring(10), DefaultConfig)
+	results, err := sc.Run(s)
+	require.NoError(t, err)
+	require.Len(t, results, 6)
+	require.Equal(t, "start", results[0].Action)
+	for _, r := range results {
+		require.True(t, r.Metrics.Converged)
+	}
+
+	require.Equal(t, 1, results[1].Metrics.Changes)
+	require.Equal(t, 3+6, results[2].Metrics.Changes)
+	require.Len(t, s.Nodes(), 12)
+	require.Len(t, s.Connectivity("12").Dump(), 12)
+
+	for _, script := range []string{
+		"at 1s frobnicate",
+		"at 1s add many nodes",
+		"at 1s add -1 nodes",
+		"at 1s add 2 nodes with -1 links",
+		"at 2s heal\nat 1s heal",
+		"in 1s heal",
+	} {
+		_, err := ParseScenario(strings.NewReader(script))
+		require.Error(t, err)
+	}
+
+	sc, err = ParseScenario(strings.NewReader("at 1s cut 0-2"))
+	require.NoError(t, err)
+	_, err = sc.Run(New(gen.Ring(10), DefaultConfig))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 1: no link 0-2")
+}
+
+// Nodes computing trees from equal graphs share the tree, and see
+// the same generation
+func TestSharedTrees(t *testing.T) {
+	trees := newSharedTrees(propagation.DefaultConfig.TreePolicy)
+	ap, a := trees.nodePolicy()
+	bp, b := trees.nodePolicy()
+
+	g := gen.RandomConnected(1, 20, 10)
+	ta := ap.BuildTree(g.Graph())
+	tb := bp.BuildTree(g.Graph())
+	require.Equal(t, a.propagationGeneration(), b.propagationGeneration())
+	require.True(t, ta.Diff(tb).Empty())
+	require.True(t, ta.Diff(propagation.DefaultConfig.TreePolicy.BuildTree(g.Graph())).Empty())
+
+	// Updating incrementally gives a different tree
+	parents := map[NodeID]NodeID{}
+	ap.(propagation.IncrementalTreePolicy).UpdateTree(parents, g.Graph())
+	require.NotEqual(t, a.propagationGeneration(), b.propagationGeneration())
+	bp.(propagation.IncrementalTreePolicy).UpdateTree(parents, g.Graph())
+	require.Equal(t, a.propagationGeneration(), b.propagationGeneration())
+
+	// A different graph gives a different tree
+	delete(g.Edges, g.SortedEdges()[0])
+	bp.BuildTree(g.Graph())
+	require.NotEqual(t, a.built, b.built)
+}
+
+// Equal graphs are shared, and the converged nodes of a simulation
+// hold the same graph
+func TestSharedGraphs(t *testing.T) {
+	graphs := newSharedGraphs()
+	g := gen.RandomConnected(1, 20, 10)
+	a := graph.NewIndexed(g.Graph())
+	require.Same(t, a, graphs.share(a))
+	require.Same(t, a, graphs.share(graph.NewIndexed(g.Graph())))
+
+	delete(g.Edges, g.SortedEdges()[0])
+	b := graph.NewIndexed(g.Graph())
+	require.Same(t, b, graphs.share(b))
+
+	s := New(gen.RandomConnected(1, 20, 10), DefaultConfig)
+	require.True(t, s.Run().Converged)
+	nodes := s.Connectivity("0").Graph().Nodes
+	for _, n := range s.Nodes() {
+		require.Same(t, &nodes[0], &s.Connectivity(n).Graph().Nodes[0])
+	}
+}
@@ -0,0 +1,281 @@
+package sim
+
+import (
+	"hash/maphash"
+	"maps"
+	"slices"
+
+	"github.com/dpw/monotreme/graph"
+	"github.com/dpw/monotreme/propagation"
+	. "github.com/dpw/monotreme/rudiments"
+)
+
+// Nodes that agree about the connectivity of the cluster compute the
+// same spanning tree from the same graph, and in a large simulation,
+// computing it once for each node dominates the cost.  So the tree
+// policies of the nodes of a simulation share the trees computed
+// recently, and return the same tree again for an equal graph.
+
+// The number of trees kept.  During a burst of changes, the nodes
+// hold a few different graphs at once.
+const sharedTreesLen = 16
+
+type sharedTrees struct {
+	policy  propagation.TreePolicy
+	seed    maphash.Seed
+	entries map[uint64]*treeEntry
+
+	// The keys of the entries, oldest first
+	keys []uint64
+
+	// The generation of the last tree computed
+	generation uint64
+}
+
+// A tree and the arguments it was computed from.  parents is nil
+// unless the tree was computed incrementally.
+type treeEntry struct {
+	incremental bool
+	g           graph.Graph
+	parents     map[NodeID]NodeID
+	tree        graph.Tree
+
+	// Numbers the trees computed, so that trees with the same
+	// generation are the same tree
+	generation uint64
+}
+
+func newSharedTrees(policy propagation.TreePolicy) *sharedTrees {
+	return &sharedTrees{
+		policy:  policy,
+		seed:    maphash.MakeSeed(),
+		entries: make(map[uint64]*treeEntry),
+	}
+}
+
+// The tree policy of one node.  It records the generations of the
+// trees last returned to the node, so that the simulation can tell
+// whether the node's tree changed without comparing the trees.
+type nodeTreePolicy struct {
+	*sharedTrees
+
+	// The generations of the trees last returned by BuildTree and
+	// UpdateTree, or zero if none
+	built, updated uint64
+}
+
+type nodeIncrementalTreePolicy struct {
+	*nodeTreePolicy
+}
+
+// Make the policy for a node.  It is incremental if the shared policy
+// is.
+func (st *sharedTrees) nodePolicy() (propagation.TreePolicy, *nodeTreePolicy) {
+	p := &nodeTreePolicy{sharedTrees: st}
+	if _, ok := st.policy.(propagation.IncrementalTreePolicy); ok {
+		return nodeIncrementalTreePolicy{p}, p
+	}
+
+	return p, p
+}
+
+func (p *nodeTreePolicy) Name() string {
+	return p.policy.Name()
+}
+
+func (p *nodeTreePolicy) Weighted() bool {
+	return p.policy.Weighted()
+}
+
+func (p *nodeTreePolicy) BuildTree(g graph.Graph) graph.Tree {
+	e := p.tree(treeEntry{g: g})
+	p.built = e.generation
+	return e.tree
+}
+
+func (p nodeIncrementalTreePolicy) UpdateTree(parents map[NodeID]NodeID, g graph.Graph) graph.Tree {
+	e := p.tree(treeEntry{incremental: true, g: g, parents: parents})
+	p.updated = e.generation
+	return e.tree
+}
+
+// The generation of the tree over which the node propagates updates:
+// the incremental tree if it is maintained, and otherwise the tree
+// built from scratch.
+func (p *nodeTreePolicy) propagationGeneration() uint64 {
+	if p.updated != 0 {
+		return p.updated
+	}
+
+	return p.built
+}
+
+// Find the tree for the arguments in e, computing it if it is not
+// kept
+func (st *sharedTrees) tree(e treeEntry) *treeEntry {
+	key := st.hash(e)
+	if kept := st.entries[key]; kept != nil && st.equal(*kept, e) {
+		return kept
+	}
+
+	if e.incremental {
+		e.tree = st.policy.(propagation.IncrementalTreePolicy).UpdateTree(e.parents, e.g)
+	} else {
+		e.tree = st.policy.BuildTree(e.g)
+	}
+
+	if _, present := st.entries[key]; !present {
+		if len(st.keys) == sharedTreesLen {
+			delete(st.entries, st.keys[0])
+			st.keys = st.keys[1:]
+		}
+
+		st.keys = append(st.keys, key)
+	}
+
+	st.generation++
+	e.generation = st.generation
+	st.entries[key] = &e
+	return &e
+}
+
+func (st *sharedTrees) hash(e treeEntry) uint64 {
+	var h maphash.Hash
+	h.SetSeed(st.seed)
+	if e.incremental {
+		h.WriteByte(1)
+	}
+
+	weighted := e.g.Weight != nil && st.policy.Weighted()
+	var buf [8]byte
+	for _, n := range e.g.Nodes {
+		h.WriteString(string(n))
+		h.WriteByte(0)
+		for _, m := range e.g.Edges(n) {
+			h.WriteString(string(m))
+			h.WriteByte(1)
+			if weighted {
+				w := uint64(e.g.Weight(n, m))
+				for i := range buf {
+					buf[i] = byte(w >> (8 * i))
+				}
+				h.Write(buf[:])
+			}
+		}
+	}
+
+	// The parents are hashed independently of their order
+	sum := h.Sum64()
+	for n, p := range e.parents {
+		var ph maphash.Hash
+		ph.SetSeed(st.seed)
+		ph.WriteString(string(n))
+		ph.WriteByte(0)
+		ph.WriteString(string(p))
+		sum += ph.Sum64()
+	}
+
+	return sum
+}
+
+func (st *sharedTrees) equal(a, b treeEntry) bool {
+	if a.incremental != b.incremental ||
+		!slices.Equal(a.g.Nodes, b.g.Nodes) ||
+		!maps.Equal(a.parents, b.parents) {
+		return false
+	}
+
+	weighted := a.g.Weight != nil && b.g.Weight != nil &&
+		st.policy.Weighted()
+	if st.policy.Weighted() && !weighted &&
+		(a.g.Weight != nil || b.g.Weight != nil) {
+		return false
+	}
+
+	for _, n := range a.g.Nodes {
+		edges := a.g.Edges(n)
+		if !slices.Equal(edges, b.g.Edges(n)) {
+			return false
+		}
+
+		if weighted {
+			for _, m := range edges {
+				if a.g.Weight(n, m) != b.g.Weight(n, m) {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// In the same way, the nodes of a simulation share the graphs they
+// compute from equal connectivity states, so that a large simulation
+// holds a few copies of the graph rather than one for each node.
+type sharedGraphs struct {
+	seed    maphash.Seed
+	entries map[uint64]*graph.Indexed
+
+	// The keys of the entries, oldest first
+	keys []uint64
+}
+
+func newSharedGraphs() *sharedGraphs {
+	return &sharedGraphs{
+		seed:    maphash.MakeSeed(),
+		entries: make(map[uint64]*graph.Indexed),
+	}
+}
+
+// Return a kept graph equal to ig, or keep ig
+func (sg *sharedGraphs) share(ig *graph.Indexed) *graph.Indexed {
+	key := sg.hash(ig)
+	kept, present := sg.entries[key]
+	if present && kept.Equal(ig) {
+		return kept
+	}
+
+	if !present {
+		if len(sg.keys) == sharedTreesLen {
+			delete(sg.entries, sg.keys[0])
+			sg.keys = sg.keys[1:]
+		}
+
+		sg.keys = append(sg.keys, key)
+	}
+
+	sg.entries[key] = ig
+	return ig
+}
+
+func (sg *sharedGraphs) hash(ig *graph.Indexed) uint64 {
+	var h maphash.Hash
+	h.SetSeed(sg.seed)
+	var buf [8]byte
+	writeInt := func(v int) {
+		for i := range buf {
+			buf[i] = byte(uint64(v) >> (8 * i))
+		}
+		h.Write(buf[:])
+	}
+
+	for _, n := range ig.IDs {
+		h.WriteString(string(n))
+		h.WriteByte(0)
+	}
+
+	for _, v := range ig.Offsets {
+		writeInt(v)
+	}
+
+	for _, v := range ig.Targets {
+		writeInt(v)
+	}
+
+	for _, v := range ig.Weights {
+		writeInt(v)
+	}
+
+	return h.Sum64()
+}